@@ -0,0 +1,83 @@
+package xmiddleware
+
+import (
+	"google.golang.org/grpc"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/interceptor"
+)
+
+// NewClient dials target with the client interceptors, transport credentials
+// must be given by ClientDialOptions.
+func NewClient(target string, cos ...XClientOption) (*grpc.ClientConn, error) {
+	opt := &clientOptions{}
+	for _, o := range cos {
+		o(opt)
+	}
+
+	logger := opt.logger
+	if logger == nil {
+		logger = interceptor.NewRequestLogger()
+	}
+	unary := []grpc.UnaryClientInterceptor{logger.ClientLogging}
+	stream := []grpc.StreamClientInterceptor{logger.StreamClientLogging}
+
+	var m *interceptor.ClientMonitor
+	if opt.application != "" {
+		m = interceptor.NewClientMonitor(opt.application, target, opt.registerer)
+		unary = append(unary, m.Monitoring)
+		stream = append(stream, m.StreamMonitoring)
+	}
+	if opt.timeout > 0 {
+		unary = append(unary, interceptor.ClientTimeout(opt.timeout))
+	}
+	retryOpts := opt.retryOpts
+	if opt.idempotency != nil {
+		retryOpts = append([]interceptor.CallOption{interceptor.WithIdempotency(opt.idempotency)}, retryOpts...)
+	}
+	if bc := opt.budget; bc != nil {
+		budget := interceptor.NewRetryBudget(target, bc.ratio, bc.capacity)
+		if opt.application != "" {
+			budget.RegisterMetrics(opt.application, opt.registerer)
+		}
+		retryOpts = append([]interceptor.CallOption{interceptor.WithRetryBudget(budget)}, retryOpts...)
+	}
+	// retry is always installed so that its CallOptions never reach grpc.
+	unary = append(unary, interceptor.UnaryClientRetry(retryOpts...))
+	stream = append(stream, interceptor.StreamClientRetry(retryOpts...))
+	if opt.hedge != nil {
+		conf := *opt.hedge
+		if conf.Idempotency == nil {
+			conf.Idempotency = opt.idempotency
+		}
+		h := interceptor.NewHedger(target, conf)
+		if opt.application != "" {
+			h.RegisterMetrics(opt.application, opt.registerer)
+		}
+		unary = append(unary, h.ClientHedging)
+	}
+	if m != nil {
+		unary = append(unary, m.AttemptMonitoring)
+	}
+	if bc := opt.breaker; bc != nil {
+		cb := interceptor.NewCircuitBreaker(target, bc.conf)
+		for _, hook := range bc.hooks {
+			cb.OnStateChange(hook)
+		}
+		if opt.application != "" {
+			cb.RegisterMetrics(opt.application, opt.registerer)
+		}
+		unary = append(unary, cb.ClientBreaker)
+	}
+	if opt.rc != nil {
+		rc := opt.rc
+		rl := interceptor.NewRateLimiter(rc.fillInterval, rc.capacity, rc.quantum)
+		unary = append(unary, rl.ClientRateLimit)
+		stream = append(stream, rl.StreamClientRateLimit)
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		interceptor.WithUnaryClientInterceptors(unary...),
+		interceptor.WithStreamClientInterceptors(stream...),
+	}, opt.dialOpts...)
+	return grpc.Dial(target, dialOpts...)
+}
@@ -0,0 +1,192 @@
+package xmiddleware
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/interceptor"
+)
+
+// HealthServer implements the standard health service. Unlike health.Server,
+// the overall status of the server, service "", can be changed, and Shutdown
+// marks every service as NOT_SERVING for good.
+type HealthServer struct {
+	mu        sync.Mutex
+	shutdown  bool
+	statusMap map[string]healthpb.HealthCheckResponse_ServingStatus
+}
+
+func NewHealthServer() *HealthServer {
+	return &HealthServer{
+		statusMap: map[string]healthpb.HealthCheckResponse_ServingStatus{
+			"": healthpb.HealthCheckResponse_SERVING,
+		},
+	}
+}
+
+func (h *HealthServer) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.statusMap[in.Service]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service")
+	}
+	if h.shutdown {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return &healthpb.HealthCheckResponse{Status: status}, nil
+}
+
+func (h *HealthServer) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	h.mu.Lock()
+	h.statusMap[service] = status
+	h.mu.Unlock()
+}
+
+// Shutdown sets every service as NOT_SERVING, ignoring later SetServingStatus.
+func (h *HealthServer) Shutdown() {
+	h.mu.Lock()
+	h.shutdown = true
+	h.mu.Unlock()
+}
+
+// healthWatcher derives the health status from the middleware state.
+type healthWatcher struct {
+	health    *HealthServer
+	server    *grpc.Server
+	throttler *interceptor.Throttler
+	monitor   *interceptor.Monitor
+	conf      *healthConf
+
+	saturatedSince time.Time
+	panicSamples   []panicSample
+	failing        map[string]string // service -> reason
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+type panicSample struct {
+	at     time.Time
+	panics uint64
+}
+
+func newHealthWatcher(health *HealthServer, server *grpc.Server, t *interceptor.Throttler, m *interceptor.Monitor, conf *healthConf) *healthWatcher {
+	return &healthWatcher{
+		health:    health,
+		server:    server,
+		throttler: t,
+		monitor:   m,
+		conf:      conf,
+		failing:   make(map[string]string),
+		quit:      make(chan struct{}),
+	}
+}
+
+func (w *healthWatcher) run() {
+	w.update(time.Now())
+	ticker := time.NewTicker(w.conf.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.update(now)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *healthWatcher) stop() {
+	w.quitOnce.Do(func() {
+		close(w.quit)
+	})
+}
+
+func (w *healthWatcher) update(now time.Time) {
+	failing := make(map[string]string)
+	if reason := w.throttleFailure(now); reason != "" {
+		failing[""] = reason
+	}
+	if reason := w.panicFailure(now); reason != "" {
+		failing[""] = reason
+	}
+	for _, c := range w.conf.checks {
+		if _, ok := failing[c.service]; ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), w.conf.interval)
+		err := c.check(ctx)
+		cancel()
+		if err != nil {
+			failing[c.service] = fmt.Sprintf("check failed: %v", err)
+		}
+	}
+
+	services := []string{""}
+	for name := range w.server.GetServiceInfo() {
+		services = append(services, name)
+	}
+	for _, svc := range services {
+		reason, ok := failing[""]
+		if !ok {
+			reason, ok = failing[svc]
+		}
+		if ok {
+			w.health.SetServingStatus(svc, healthpb.HealthCheckResponse_NOT_SERVING)
+		} else {
+			w.health.SetServingStatus(svc, healthpb.HealthCheckResponse_SERVING)
+		}
+		if old, wasFailing := w.failing[svc]; ok != wasFailing || reason != old {
+			if ok {
+				log.Warnf("health: %q NOT_SERVING, %s", svc, reason)
+			} else {
+				log.Infof("health: %q SERVING", svc)
+			}
+		}
+		if ok {
+			failing[svc] = reason
+		}
+	}
+	w.failing = failing
+}
+
+func (w *healthWatcher) throttleFailure(now time.Time) string {
+	if w.throttler == nil || w.conf.throttleWindow <= 0 {
+		return ""
+	}
+	if !w.throttler.Saturated() {
+		w.saturatedSince = time.Time{}
+		return ""
+	}
+	if w.saturatedSince.IsZero() {
+		w.saturatedSince = now
+	}
+	if now.Sub(w.saturatedSince) < w.conf.throttleWindow {
+		return ""
+	}
+	return fmt.Sprintf("throttler saturated since %v", w.saturatedSince.Format(time.RFC3339))
+}
+
+func (w *healthWatcher) panicFailure(now time.Time) string {
+	if w.monitor == nil || w.conf.panicThreshold <= 0 {
+		return ""
+	}
+	w.panicSamples = append(w.panicSamples, panicSample{at: now, panics: w.monitor.Panics()})
+	// keep the latest sample at least as old as the window as the baseline.
+	for len(w.panicSamples) > 1 && now.Sub(w.panicSamples[1].at) >= w.conf.panicWindow {
+		w.panicSamples = w.panicSamples[1:]
+	}
+	oldest, latest := w.panicSamples[0], w.panicSamples[len(w.panicSamples)-1]
+	if n := latest.panics - oldest.panics; n >= uint64(w.conf.panicThreshold) {
+		return fmt.Sprintf("%d panics within %v", n, w.conf.panicWindow)
+	}
+	return ""
+}
@@ -0,0 +1,303 @@
+package interceptor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	breakerBuckets = 10 // buckets of the rolling window
+)
+
+// DefaultBreakerCodes are the codes counted as failures by the circuit breaker.
+var DefaultBreakerCodes = []codes.Code{
+	codes.Unknown, codes.DeadlineExceeded, codes.ResourceExhausted,
+	codes.Internal, codes.Unavailable, codes.DataLoss,
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerHook is called on every state change of the circuit of method, with
+// the breaker locked, so it must not block.
+type BreakerHook func(target string, method string, from BreakerState, to BreakerState)
+
+// BreakerConf configures CircuitBreaker. The circuit opens when either
+// threshold is reached, a zero threshold is disabled.
+type BreakerConf struct {
+	Window              time.Duration // rolling window of the failure rate
+	MinRequests         int           // calls in the window before the failure rate counts
+	FailureRate         float64       // in (0, 1]
+	ConsecutiveFailures int
+	OpenTimeout         time.Duration // before letting probes through
+	HalfOpenRequests    int           // probes, which must all succeed to close the circuit
+	FailureCodes        []codes.Code  // DefaultBreakerCodes if empty
+}
+
+// CircuitBreaker fails fast the calls to a target, per method, while they keep failing.
+type CircuitBreaker struct {
+	target       string
+	conf         BreakerConf
+	failureCodes map[codes.Code]bool
+	hooks        []BreakerHook
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+
+	stateGauge *prometheus.GaugeVec
+	rejected   *prometheus.CounterVec
+}
+
+func NewCircuitBreaker(target string, conf BreakerConf) *CircuitBreaker {
+	if conf.Window < breakerBuckets {
+		panic("xmiddleware/breaker: Window expects to be at least 10ns")
+	}
+	if conf.FailureRate < 0 || conf.FailureRate > 1 {
+		panic("xmiddleware/breaker: FailureRate expects to be in [0, 1]")
+	}
+	if conf.FailureRate == 0 && conf.ConsecutiveFailures <= 0 {
+		panic("xmiddleware/breaker: expects FailureRate or ConsecutiveFailures")
+	}
+	if conf.HalfOpenRequests < 1 {
+		conf.HalfOpenRequests = 1
+	}
+	if len(conf.FailureCodes) == 0 {
+		conf.FailureCodes = DefaultBreakerCodes
+	}
+
+	cb := &CircuitBreaker{
+		target:       target,
+		conf:         conf,
+		failureCodes: make(map[codes.Code]bool, len(conf.FailureCodes)),
+		circuits:     make(map[string]*circuit),
+	}
+	for _, c := range conf.FailureCodes {
+		cb.failureCodes[c] = true
+	}
+	return cb
+}
+
+// OnStateChange adds a hook, it must be called before calling.
+func (cb *CircuitBreaker) OnStateChange(hook BreakerHook) {
+	cb.hooks = append(cb.hooks, hook)
+}
+
+// RegisterMetrics exports the state of the circuits and the calls failed fast,
+// it must be called before calling.
+func (cb *CircuitBreaker) RegisterMetrics(application string, registerer prometheus.Registerer) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	cb.stateGauge = register(registerer, prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: application,
+			Name:      "client_breaker_state",
+			Help:      "State of the client circuit breaker: 0 closed, 1 open, 2 half-open",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.GaugeVec)
+	cb.rejected = register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: application,
+			Name:      "client_breaker_rejected_total",
+			Help:      "Client calls failed fast by the circuit breaker",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.CounterVec)
+}
+
+// State returns the state of the circuit of method.
+func (cb *CircuitBreaker) State(method string) BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.circuits[method]; ok {
+		return c.state
+	}
+	return BreakerClosed
+}
+
+func (cb *CircuitBreaker) ClientBreaker(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	period, ok := cb.allow(method)
+	if !ok {
+		if cb.rejected != nil {
+			cb.rejected.With(prometheus.Labels{"target": cb.target, "endpoint": method}).Inc()
+		}
+		return grpc.Errorf(codes.Unavailable, "Circuit breaker open for %s", method)
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if grpc.Code(err) == codes.Canceled || ctx.Err() == context.Canceled {
+		// given up by the caller, e.g. a losing hedged copy: neither a failure
+		// nor a success. The calls timed out are failures.
+		cb.abandon(method, period)
+		return err
+	}
+	cb.record(method, period, err != nil && cb.failureCodes[grpc.Code(err)])
+	return err
+}
+
+// circuit is the state of a method, guarded by CircuitBreaker.mu.
+type circuit struct {
+	state       BreakerState
+	period      uint64 // incremented on every state change
+	openedAt    time.Time
+	buckets     [breakerBuckets]breakerBucket
+	consecutive int
+	probes      int // calls let through while half-open
+	successes   int // probes succeeded
+}
+
+type breakerBucket struct {
+	index    int64
+	total    int
+	failures int
+}
+
+// allow reports whether a call may be made, and the period of the circuit it
+// is let through in.
+func (cb *CircuitBreaker) allow(method string) (uint64, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.circuit(method)
+	switch c.state {
+	case BreakerClosed:
+		return c.period, true
+	case BreakerOpen:
+		if time.Since(c.openedAt) < cb.conf.OpenTimeout {
+			return c.period, false
+		}
+		cb.setState(method, c, BreakerHalfOpen)
+	}
+	if c.probes >= cb.conf.HalfOpenRequests {
+		return c.period, false
+	}
+	c.probes++
+	return c.period, true
+}
+
+func (cb *CircuitBreaker) record(method string, period uint64, failure bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.circuit(method)
+	if c.period != period {
+		// let through before the last state change.
+		return
+	}
+	switch c.state {
+	case BreakerClosed:
+		b := c.bucket(cb.conf.Window)
+		b.total++
+		c.consecutive++
+		if failure {
+			b.failures++
+		} else {
+			c.consecutive = 0
+		}
+		if failure && cb.tripped(c) {
+			cb.setState(method, c, BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if failure {
+			cb.setState(method, c, BreakerOpen)
+			return
+		}
+		c.successes++
+		if c.successes >= cb.conf.HalfOpenRequests {
+			cb.setState(method, c, BreakerClosed)
+		}
+	}
+}
+
+// abandon gives back the slot of a probe whose outcome is unknown, if it
+// belongs to the current half-open period.
+func (cb *CircuitBreaker) abandon(method string, period uint64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c := cb.circuit(method); c.state == BreakerHalfOpen && c.period == period && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// tripped reports whether c reached a threshold, cb.mu must be held.
+func (cb *CircuitBreaker) tripped(c *circuit) bool {
+	if n := cb.conf.ConsecutiveFailures; n > 0 && c.consecutive >= n {
+		return true
+	}
+	if cb.conf.FailureRate == 0 {
+		return false
+	}
+	total, failures := c.counts(cb.conf.Window)
+	return total >= cb.conf.MinRequests && total > 0 &&
+		float64(failures)/float64(total) >= cb.conf.FailureRate
+}
+
+func (cb *CircuitBreaker) circuit(method string) *circuit {
+	c, ok := cb.circuits[method]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[method] = c
+	}
+	return c
+}
+
+// setState moves c to state, resetting its counts, cb.mu must be held.
+func (cb *CircuitBreaker) setState(method string, c *circuit, state BreakerState) {
+	from := c.state
+	*c = circuit{state: state, period: c.period + 1}
+	if state == BreakerOpen {
+		c.openedAt = time.Now()
+	}
+
+	log.Warnf("circuit breaker: %s%s: %v -> %v", cb.target, method, from, state)
+	if cb.stateGauge != nil {
+		cb.stateGauge.With(prometheus.Labels{"target": cb.target, "endpoint": method}).Set(float64(state))
+	}
+	for _, hook := range cb.hooks {
+		hook(cb.target, method, from, state)
+	}
+}
+
+// bucket returns the bucket of the current time, cleared if outdated.
+func (c *circuit) bucket(window time.Duration) *breakerBucket {
+	index := time.Now().UnixNano() / int64(window/breakerBuckets)
+	b := &c.buckets[index%breakerBuckets]
+	if b.index != index {
+		*b = breakerBucket{index: index}
+	}
+	return b
+}
+
+// counts sums the buckets within the window.
+func (c *circuit) counts(window time.Duration) (total int, failures int) {
+	index := time.Now().UnixNano() / int64(window/breakerBuckets)
+	for _, b := range c.buckets {
+		if index-b.index < breakerBuckets {
+			total += b.total
+			failures += b.failures
+		}
+	}
+	return total, failures
+}
@@ -0,0 +1,79 @@
+package interceptor
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// hangingInvoker waits for the end of ctx, like a call to a hanging backend.
+func hangingInvoker(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+	<-ctx.Done()
+	return convToGrpcErr(ctx.Err())
+}
+
+func TestBreakerOpensOnTimeouts(t *testing.T) {
+	cb := NewCircuitBreaker("test", BreakerConf{Window: time.Second, ConsecutiveFailures: 3, OpenTimeout: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		err := cb.ClientBreaker(ctx, checkMethod, nil, nil, nil, hangingInvoker)
+		cancel()
+		if grpc.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("call %d = %v, want DeadlineExceeded", i, err)
+		}
+	}
+	if state := cb.State(checkMethod); state != BreakerOpen {
+		t.Errorf("state after 3 timeouts = %v, want open", state)
+	}
+}
+
+func TestBreakerIgnoresCanceled(t *testing.T) {
+	cb := NewCircuitBreaker("test", BreakerConf{Window: time.Second, ConsecutiveFailures: 3, OpenTimeout: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		cb.ClientBreaker(ctx, checkMethod, nil, nil, nil, hangingInvoker)
+	}
+	if state := cb.State(checkMethod); state != BreakerClosed {
+		t.Errorf("state after canceled calls = %v, want closed", state)
+	}
+}
+
+func TestBreakerAbandonOfPastPeriod(t *testing.T) {
+	cb := NewCircuitBreaker("test", BreakerConf{Window: time.Second, ConsecutiveFailures: 1, OpenTimeout: time.Millisecond, HalfOpenRequests: 2})
+	first, _ := cb.allow(checkMethod)
+	cb.record(checkMethod, first, true)
+	time.Sleep(2 * time.Millisecond)
+
+	// two probes, the second fails and opens the circuit again.
+	abandoned, ok := cb.allow(checkMethod)
+	if !ok {
+		t.Fatal("first probe not allowed")
+	}
+	failed, _ := cb.allow(checkMethod)
+	cb.record(checkMethod, failed, true)
+	time.Sleep(2 * time.Millisecond)
+
+	// the probe of the next half-open period keeps its slot.
+	if _, ok := cb.allow(checkMethod); !ok {
+		t.Fatal("probe of the next period not allowed")
+	}
+	cb.abandon(checkMethod, abandoned)
+	if probes := cb.circuits[checkMethod].probes; probes != 1 {
+		t.Errorf("%d probes after abandoning a past probe, want 1", probes)
+	}
+}
+
+func TestNewCircuitBreakerTinyWindow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewCircuitBreaker accepted a window shorter than its buckets")
+		}
+	}()
+	NewCircuitBreaker("test", BreakerConf{Window: 5, ConsecutiveFailures: 1})
+}
@@ -0,0 +1,95 @@
+package interceptor
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryBudget bounds the retries to a target to a ratio of the calls, so that
+// retries cannot multiply the load of a failing target. Every call deposits
+// ratio tokens, up to capacity, and every retry takes one.
+type RetryBudget struct {
+	target   string
+	ratio    float64
+	capacity float64
+
+	mu     sync.Mutex
+	tokens float64
+
+	retries    *prometheus.CounterVec
+	suppressed *prometheus.CounterVec
+}
+
+// NewRetryBudget returns a full budget, it should be shared by the calls to target.
+func NewRetryBudget(target string, ratio float64, capacity int) *RetryBudget {
+	if ratio <= 0 {
+		panic("xmiddleware/retry: ratio expects to be positive")
+	}
+	if capacity < 1 {
+		panic("xmiddleware/retry: capacity expects to be positive")
+	}
+
+	return &RetryBudget{
+		target:   target,
+		ratio:    ratio,
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+	}
+}
+
+// RegisterMetrics exports the retries attempted and suppressed, it must be
+// called before calling.
+func (b *RetryBudget) RegisterMetrics(application string, registerer prometheus.Registerer) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	b.retries = register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: application,
+			Name:      "client_retries_total",
+			Help:      "Client retries attempted within the retry budget",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.CounterVec)
+	b.suppressed = register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: application,
+			Name:      "client_retries_suppressed_total",
+			Help:      "Client retries suppressed by the retry budget",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.CounterVec)
+}
+
+// take deposits for a first attempt, and reports whether a retry is within
+// the budget. A nil budget allows every retry.
+func (b *RetryBudget) take(method string, attempt uint) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	if attempt == 0 {
+		b.tokens += b.ratio
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.mu.Unlock()
+		return true
+	}
+	ok := b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+	b.mu.Unlock()
+
+	counter := b.retries
+	if !ok {
+		counter = b.suppressed
+	}
+	if counter != nil {
+		counter.With(prometheus.Labels{"target": b.target, "endpoint": method}).Inc()
+	}
+	return ok
+}
@@ -27,6 +27,27 @@ func WithUnaryServerInterceptors(interceptors ...grpc.UnaryServerInterceptor) gr
 	return grpc.UnaryInterceptor(UnaryServerChain(interceptors...))
 }
 
+// StreamServerChain build the multi stream interceptors into one interceptor chain.
+func StreamServerChain(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chain := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chain = buildStreamServerChain(interceptors[i], chain, info)
+		}
+		return chain(srv, ss)
+	}
+}
+
+func buildStreamServerChain(c grpc.StreamServerInterceptor, n grpc.StreamHandler, info *grpc.StreamServerInfo) grpc.StreamHandler {
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		return c(srv, ss, info, n)
+	}
+}
+
+func WithStreamServerInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.ServerOption {
+	return grpc.StreamInterceptor(StreamServerChain(interceptors...))
+}
+
 // -------------
 
 func UnaryClientChain(interceptors ...grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
@@ -48,3 +69,23 @@ func buildClientChain(current grpc.UnaryClientInterceptor, next grpc.UnaryInvoke
 func WithUnaryClientInterceptors(interceptors ...grpc.UnaryClientInterceptor) grpc.DialOption {
 	return grpc.WithUnaryInterceptor(UnaryClientChain(interceptors...))
 }
+
+func StreamClientChain(interceptors ...grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		chain := streamer
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chain = buildStreamClientChain(interceptors[i], chain)
+		}
+		return chain(ctx, desc, cc, method, opts...)
+	}
+}
+
+func buildStreamClientChain(current grpc.StreamClientInterceptor, next grpc.Streamer) grpc.Streamer {
+	return func(currentCtx context.Context, currentDesc *grpc.StreamDesc, currentConn *grpc.ClientConn, currentMethod string, currentOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return current(currentCtx, currentDesc, currentConn, currentMethod, next, currentOpts...)
+	}
+}
+
+func WithStreamClientInterceptors(interceptors ...grpc.StreamClientInterceptor) grpc.DialOption {
+	return grpc.WithStreamInterceptor(StreamClientChain(interceptors...))
+}
@@ -0,0 +1,207 @@
+package interceptor
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+// ClientMonitor records metrics of outbound calls to a single target.
+type ClientMonitor struct {
+	target         string
+	reqCounter     *prometheus.CounterVec
+	errCounter     *prometheus.CounterVec
+	respLatency    *prometheus.HistogramVec
+	attemptCounter *prometheus.CounterVec
+	attemptLatency *prometheus.HistogramVec
+}
+
+// NewClientMonitor registers the metrics with registerer, prometheus.DefaultRegisterer if nil.
+func NewClientMonitor(application string, target string, registerer prometheus.Registerer, buckets ...float64) *ClientMonitor {
+	m := ClientMonitor{target: target}
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	m.reqCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "client_requests_total",
+			Help:        "Total client request counts",
+			ConstLabels: prometheus.Labels{"method": "rpc"},
+		},
+		[]string{
+			"target", "endpoint", "code",
+		},
+	)
+	m.reqCounter = register(registerer, m.reqCounter).(*prometheus.CounterVec)
+
+	m.errCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "client_error_total",
+			Help:        "Total client error counts",
+			ConstLabels: prometheus.Labels{"method": "rpc"},
+		},
+		[]string{
+			"target", "endpoint", "code",
+		},
+	)
+	m.errCounter = register(registerer, m.errCounter).(*prometheus.CounterVec)
+
+	if len(buckets) == 0 {
+		buckets = defaultBuckets
+	}
+	m.respLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   application,
+			Name:        "client_response_latency_millisecond",
+			Help:        "Client response latency (millisecond)",
+			ConstLabels: prometheus.Labels{"method": "rpc"},
+			Buckets:     buckets,
+		},
+		[]string{
+			"target", "endpoint",
+		},
+	)
+	m.respLatency = register(registerer, m.respLatency).(*prometheus.HistogramVec)
+
+	m.attemptCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "client_attempts_total",
+			Help:        "Total client attempt counts, retries included",
+			ConstLabels: prometheus.Labels{"method": "rpc"},
+		},
+		[]string{
+			"target", "endpoint", "code", "retry",
+		},
+	)
+	m.attemptCounter = register(registerer, m.attemptCounter).(*prometheus.CounterVec)
+
+	m.attemptLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   application,
+			Name:        "client_attempt_latency_millisecond",
+			Help:        "Client attempt latency (millisecond)",
+			ConstLabels: prometheus.Labels{"method": "rpc"},
+			Buckets:     buckets,
+		},
+		[]string{
+			"target", "endpoint", "retry",
+		},
+	)
+	m.attemptLatency = register(registerer, m.attemptLatency).(*prometheus.HistogramVec)
+
+	return &m
+}
+
+func (m *ClientMonitor) Observe(method string, latency float64, err error) {
+	code := grpc.Code(err).String()
+	m.reqCounter.With(prometheus.Labels{"target": m.target, "endpoint": method, "code": code}).Inc()
+	m.respLatency.With(prometheus.Labels{"target": m.target, "endpoint": method}).Observe(latency)
+	if err != nil {
+		m.errCounter.With(prometheus.Labels{"target": m.target, "endpoint": method, "code": code}).Inc()
+	}
+}
+
+func (m *ClientMonitor) ObserveAttempt(method string, retry bool, latency float64, err error) {
+	r := "false"
+	if retry {
+		r = "true"
+	}
+	code := grpc.Code(err).String()
+	m.attemptCounter.With(prometheus.Labels{"target": m.target, "endpoint": method, "code": code, "retry": r}).Inc()
+	m.attemptLatency.With(prometheus.Labels{"target": m.target, "endpoint": method, "retry": r}).Observe(latency)
+}
+
+// Monitoring records the logical call, install it before UnaryClientRetry.
+func (m *ClientMonitor) Monitoring(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	m.Observe(method, sinceMillisecond(start), err)
+
+	return err
+}
+
+// AttemptMonitoring records every single attempt, install it after UnaryClientRetry.
+func (m *ClientMonitor) AttemptMonitoring(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	m.ObserveAttempt(method, isRetryAttempt(ctx), sinceMillisecond(start), err)
+
+	return err
+}
+
+// StreamMonitoring records the stream when it fails to open or when RecvMsg or
+// SendMsg returns its end. A stream abandoned before is not recorded, so read it
+// until its end or cancel its context and read the error.
+func (m *ClientMonitor) StreamMonitoring(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		m.Observe(method, sinceMillisecond(start), err)
+		return nil, err
+	}
+	s := &monitoredClientStream{
+		ClientStream: cs,
+		monitor:      m,
+		method:       method,
+		start:        start,
+		unaryReply:   desc.ClientStreams && !desc.ServerStreams,
+	}
+	return s, nil
+}
+
+type monitoredClientStream struct {
+	grpc.ClientStream
+	monitor    *ClientMonitor
+	method     string
+	start      time.Time
+	unaryReply bool // the single response of a client streaming call ends it
+	once       sync.Once
+}
+
+func (s *monitoredClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	// io.EOF tells the stream ended, its status is returned by RecvMsg.
+	if err != nil && err != io.EOF {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *monitoredClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.finish(nil)
+	case err != nil:
+		s.finish(err)
+	case s.unaryReply:
+		s.finish(nil)
+	}
+	return err
+}
+
+// finish records the stream once.
+func (s *monitoredClientStream) finish(err error) {
+	s.once.Do(func() {
+		s.monitor.Observe(s.method, sinceMillisecond(s.start), err)
+	})
+}
+
+func isRetryAttempt(ctx context.Context) bool {
+	_, ok := meta.GetOutgoing(ctx, AttemptMetadataKey)
+	return ok
+}
+
+func sinceMillisecond(start time.Time) float64 {
+	return float64(time.Since(start).Nanoseconds()) / 1000000
+}
@@ -0,0 +1,212 @@
+package interceptor
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+const (
+	dedupPollInterval = 20 * time.Millisecond // between the looks at a call in progress elsewhere
+)
+
+// DedupResult is the response of a call, stored by its idempotency key.
+type DedupResult struct {
+	MessageName string
+	Response    []byte
+}
+
+// DedupStore stores the calls by idempotency key, for ttl.
+type DedupStore interface {
+	// Reserve marks key as in progress, unless it is stored already; then it
+	// returns false with the result of the call, nil while in progress.
+	Reserve(key string, ttl time.Duration) (bool, *DedupResult, error)
+	// Complete stores the result of the call reserved under key.
+	Complete(key string, result *DedupResult, ttl time.Duration) error
+	// Release forgets key, so that the call can be made again.
+	Release(key string) error
+}
+
+// Deduplicator serves the unary calls repeated with the same idempotency key
+// within ttl from the response of the first one, instead of processing them
+// again. The failed calls are not stored, so that they can be retried.
+//
+// A call repeated while the first one is in progress, e.g. a hedged copy or a
+// retry after WithPerRetryTimeout, waits for its response up to its deadline,
+// and is processed if the first one fails. So the hedged copies reaching the
+// servers which share the store of a Deduplicator wait for the first one.
+type Deduplicator struct {
+	store DedupStore
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	done map[string]chan struct{} // closed when the call of key in progress here ends
+}
+
+func NewDeduplicator(store DedupStore, ttl time.Duration) *Deduplicator {
+	if ttl <= 0 {
+		panic("xmiddleware/dedup: ttl expects to be positive")
+	}
+
+	return &Deduplicator{store: store, ttl: ttl, done: make(map[string]chan struct{})}
+}
+
+func (d *Deduplicator) Dedup(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	key, ok := idempotencyKey(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+	key = info.FullMethod + "/" + key
+
+	for {
+		reserved, result, err := d.store.Reserve(key, d.ttl)
+		switch {
+		case err != nil:
+			log.Warnf("dedup store failed, %s not deduplicated: %v", info.FullMethod, err)
+			return handler(ctx, req)
+		case reserved:
+			return d.serve(ctx, key, req, handler)
+		case result != nil:
+			return replay(result)
+		}
+		if err := d.wait(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// serve processes the call reserved under key and stores its response.
+func (d *Deduplicator) serve(ctx context.Context, key string, req interface{}, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	done := make(chan struct{})
+	d.mu.Lock()
+	d.done[key] = done
+	d.mu.Unlock()
+	completed := false
+	// released unless completed, also when the handler panics.
+	defer func() {
+		if !completed {
+			if rerr := d.store.Release(key); rerr != nil {
+				log.Warnf("dedup store failed to release %s: %v", key, rerr)
+			}
+		}
+		d.mu.Lock()
+		delete(d.done, key)
+		d.mu.Unlock()
+		close(done)
+	}()
+
+	resp, err = handler(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	if pb, ok := resp.(proto.Message); ok {
+		b, merr := proto.Marshal(pb)
+		if merr == nil {
+			merr = d.store.Complete(key, &DedupResult{MessageName: proto.MessageName(pb), Response: b}, d.ttl)
+		}
+		if merr != nil {
+			log.Warnf("dedup store failed to complete %s: %v", key, merr)
+		}
+		completed = merr == nil
+	}
+	return resp, err
+}
+
+// wait waits for the end of the call of key in progress, here or elsewhere.
+func (d *Deduplicator) wait(ctx context.Context, key string) error {
+	d.mu.Lock()
+	done := d.done[key]
+	d.mu.Unlock()
+
+	timer := time.NewTimer(dedupPollInterval)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+		return convToGrpcErr(ctx.Err())
+	}
+	return nil
+}
+
+func replay(result *DedupResult) (interface{}, error) {
+	t := proto.MessageType(result.MessageName)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, grpc.Errorf(codes.Internal, "Unknown stored response type %s", result.MessageName)
+	}
+	pb := reflect.New(t.Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(result.Response, pb); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Invalid stored response: %v", err)
+	}
+	return pb, nil
+}
+
+func idempotencyKey(ctx context.Context) (string, bool) {
+	key, ok := meta.Get(ctx, IdempotencyKeyMetadataKey)
+	return key, ok && key != ""
+}
+
+// ------------- memory store
+
+type memoryDedupStore struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	swept   time.Time
+}
+
+type dedupEntry struct {
+	result  *DedupResult
+	expires time.Time
+}
+
+// NewMemoryDedupStore returns a DedupStore local to the process.
+func NewMemoryDedupStore() DedupStore {
+	return &memoryDedupStore{entries: make(map[string]*dedupEntry)}
+}
+
+func (m *memoryDedupStore) Reserve(key string, ttl time.Duration) (bool, *DedupResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweep(now, ttl)
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		return false, e.result, nil
+	}
+	m.entries[key] = &dedupEntry{expires: now.Add(ttl)}
+	return true, nil, nil
+}
+
+func (m *memoryDedupStore) Complete(key string, result *DedupResult, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &dedupEntry{result: result, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryDedupStore) Release(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops the expired entries, at most once per ttl. m.mu must be held.
+func (m *memoryDedupStore) sweep(now time.Time, ttl time.Duration) {
+	if now.Sub(m.swept) < ttl {
+		return
+	}
+	m.swept = now
+	for k, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package interceptor
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+var checkInfo = &grpc.UnaryServerInfo{FullMethod: checkMethod}
+
+func keyedContext(key string) context.Context {
+	return meta.SetIncoming(context.Background(), IdempotencyKeyMetadataKey, key)
+}
+
+func TestDedupReplays(t *testing.T) {
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, handler)
+		if err != nil {
+			t.Fatalf("Dedup: %v", err)
+		}
+		if resp.(*healthpb.HealthCheckResponse).Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Dedup = %v, want SERVING", resp)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("%d calls processed, want 1", calls)
+	}
+}
+
+func TestDedupWaitsInProgress(t *testing.T) {
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	started := make(chan struct{})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+
+	go d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, handler)
+	<-started
+	resp, err := d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, handler)
+	if err != nil {
+		t.Fatalf("Dedup of the call in progress: %v", err)
+	}
+	if resp.(*healthpb.HealthCheckResponse).Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Dedup = %v, want SERVING", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("%d calls processed, want 1", calls)
+	}
+}
+
+func TestDedupProcessesAfterFailure(t *testing.T) {
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	started := make(chan struct{})
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return nil, grpc.Errorf(codes.Unavailable, "failed")
+	}
+	go d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, failing)
+	<-started
+
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+	if _, err := d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, handler); err != nil {
+		t.Fatalf("Dedup after the failure of the call in progress: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d calls processed, want the retry processed", calls)
+	}
+}
+
+func TestDedupWaitsUpToDeadline(t *testing.T) {
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+	go d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(started)
+		<-block
+		return &healthpb.HealthCheckResponse{}, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(keyedContext("k"), 50*time.Millisecond)
+	defer cancel()
+	_, err := d.Dedup(ctx, &healthpb.HealthCheckRequest{}, checkInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Error("call in progress processed again")
+		return nil, nil
+	})
+	if grpc.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Dedup = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestDedupReleasesOnPanic(t *testing.T) {
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("handler panic not propagated")
+			}
+		}()
+		d.Dedup(keyedContext("k"), &healthpb.HealthCheckRequest{}, checkInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("handler failed")
+		})
+	}()
+
+	ctx, cancel := context.WithTimeout(keyedContext("k"), time.Second)
+	defer cancel()
+	start := time.Now()
+	calls := 0
+	_, err := d.Dedup(ctx, &healthpb.HealthCheckRequest{}, checkInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &healthpb.HealthCheckResponse{}, nil
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("Dedup after a panic = %v with %d calls, want the call processed", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed >= dedupPollInterval {
+		t.Errorf("Dedup after a panic waited %v, want no wait", elapsed)
+	}
+}
@@ -0,0 +1,285 @@
+package interceptor
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	hedgeSamples    = 128 // latencies kept per method for the p95
+	hedgeMinSamples = 20  // latencies before hedging after the p95
+)
+
+// HedgeConf configures Hedger.
+type HedgeConf struct {
+	Delay          time.Duration // before sending a copy, the p95 latency of the method if 0
+	MaxHedges      int           // copies sent in addition to the call, 1 if 0
+	BudgetRatio    float64       // copies allowed per call, see RetryBudget
+	BudgetCapacity int
+	Idempotency    *IdempotencyRegistry // methods which may be hedged, required
+}
+
+// Hedger sends copies of the slow calls to a target, the first successful
+// response wins and the other copies are canceled. Only idempotent methods
+// may be hedged. The copies share the idempotency key of the call, so that a
+// server with a Deduplicator processes one of them, the others wait for it.
+type Hedger struct {
+	target  string
+	conf    HedgeConf
+	budget  *RetryBudget
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+
+	hedges     *prometheus.CounterVec
+	suppressed *prometheus.CounterVec
+}
+
+func NewHedger(target string, conf HedgeConf) *Hedger {
+	if conf.MaxHedges < 0 {
+		panic("xmiddleware/hedge: MaxHedges expects to be positive")
+	}
+	if afterCallErr != nil {
+		panic(afterCallErr)
+	}
+	if conf.Idempotency == nil {
+		panic("xmiddleware/hedge: Idempotency expects the methods which may be hedged")
+	}
+	if conf.BudgetRatio <= 0 || conf.BudgetCapacity < 1 {
+		panic("xmiddleware/hedge: BudgetRatio and BudgetCapacity expect to be positive")
+	}
+	if conf.MaxHedges == 0 {
+		conf.MaxHedges = 1
+	}
+
+	return &Hedger{
+		target:  target,
+		conf:    conf,
+		budget:  NewRetryBudget(target, conf.BudgetRatio, conf.BudgetCapacity),
+		windows: make(map[string]*latencyWindow),
+	}
+}
+
+// RegisterMetrics exports the copies sent and suppressed by the budget, it
+// must be called before calling.
+func (h *Hedger) RegisterMetrics(application string, registerer prometheus.Registerer) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	h.hedges = register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: application,
+			Name:      "client_hedges_total",
+			Help:      "Hedged copies of client calls sent",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.CounterVec)
+	h.suppressed = register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: application,
+			Name:      "client_hedges_suppressed_total",
+			Help:      "Hedged copies of client calls suppressed by the hedging budget",
+		},
+		[]string{"target", "endpoint"},
+	)).(*prometheus.CounterVec)
+}
+
+type hedgeResult struct {
+	reply proto.Message
+	err   error
+	call  *callCapture
+}
+
+func (h *Hedger) ClientHedging(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	pb, ok := reply.(proto.Message)
+	if !ok || !h.conf.Idempotency.IsIdempotent(method, req) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	delay, ok := h.delay(method)
+	if !ok {
+		return h.observe(method, time.Now(), invoker(ctx, method, req, reply, cc, opts...))
+	}
+
+	ctx, cancel := context.WithCancel(withIdempotencyKey(ctx))
+	defer cancel()
+
+	// the copies must not write the header, trailer or peer of the call
+	// concurrently, only the returned copy's are passed to the options.
+	opts, afterOpts := splitAfterOptions(opts)
+	start := time.Now()
+	results := make(chan hedgeResult, h.conf.MaxHedges+1)
+	send := func() {
+		r := proto.Clone(pb)
+		r.Reset()
+		call := &callCapture{}
+		copyOpts := append(append([]grpc.CallOption(nil), opts...), call.option())
+		go func() {
+			err := invoker(ctx, method, req, r, cc, copyOpts...)
+			results <- hedgeResult{reply: r, err: err, call: call}
+		}()
+	}
+	h.budget.take(method, 0)
+	send()
+	pending, hedges := 1, 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if h.budget.take(method, 1) {
+				h.count(h.hedges, method)
+				send()
+				pending++
+			} else {
+				h.count(h.suppressed, method)
+			}
+			if hedges++; hedges < h.conf.MaxHedges {
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				pb.Reset()
+				proto.Merge(pb, r.reply)
+				r.call.apply(afterOpts)
+				return h.observe(method, start, nil)
+			}
+			last = r
+			log.Debugf("gRPC hedged call: %s, err: %v", method, r.err)
+		}
+	}
+	last.call.apply(afterOpts)
+	return last.err
+}
+
+// afterCallType is the type of the options reading the call once completed,
+// grpc.Header, grpc.Trailer and grpc.Peer. grpc exposes neither their type nor
+// the call they read, so the Hedger reads it through reflection, which relies
+// on grpc 1.3.0 as vendored: "type afterCall func(*callInfo)" in rpc_util.go.
+// afterCallErr is set if the vendored grpc does not match, and NewHedger
+// panics with it rather than failing at call time. Revisit on any grpc upgrade,
+// later versions expose the options as structs with exported fields.
+var (
+	afterCallType = reflect.TypeOf(grpc.Trailer(nil))
+	afterCallErr  = checkAfterCallType()
+)
+
+func checkAfterCallType() error {
+	t := afterCallType
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.In(0).Kind() != reflect.Ptr || t.NumOut() != 0 {
+		return fmt.Errorf("xmiddleware/hedge: grpc.Trailer returns %v, expects the func(*callInfo) of grpc 1.3.0", t)
+	}
+	if reflect.TypeOf(grpc.Header(nil)) != t || reflect.TypeOf(grpc.Peer(nil)) != t {
+		return fmt.Errorf("xmiddleware/hedge: grpc.Header, grpc.Trailer and grpc.Peer expect the same type, as in grpc 1.3.0")
+	}
+	return nil
+}
+
+// splitAfterOptions separates the options reading the call once completed.
+func splitAfterOptions(opts []grpc.CallOption) (before []grpc.CallOption, after []grpc.CallOption) {
+	for _, o := range opts {
+		if reflect.TypeOf(o) == afterCallType {
+			after = append(after, o)
+		} else {
+			before = append(before, o)
+		}
+	}
+	return before, after
+}
+
+// callCapture retains the completed call of a copy, to read it with the
+// options of the caller once the copy is returned.
+type callCapture struct {
+	info reflect.Value // *grpc.callInfo
+}
+
+func (c *callCapture) option() grpc.CallOption {
+	return reflect.MakeFunc(afterCallType, func(args []reflect.Value) []reflect.Value {
+		c.info = args[0]
+		return nil
+	}).Interface().(grpc.CallOption)
+}
+
+// apply runs opts on the captured call, if the copy reached the transport.
+func (c *callCapture) apply(opts []grpc.CallOption) {
+	if !c.info.IsValid() {
+		return
+	}
+	for _, o := range opts {
+		reflect.ValueOf(o).Call([]reflect.Value{c.info})
+	}
+}
+
+// delay returns the delay before sending a copy, false while the p95 of the
+// method is not known yet.
+func (h *Hedger) delay(method string) (time.Duration, bool) {
+	if h.conf.Delay > 0 {
+		return h.conf.Delay, true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok := h.windows[method]
+	if !ok || w.n < hedgeMinSamples {
+		return 0, false
+	}
+	return w.p95, true
+}
+
+// observe records the latency of the successful calls, returning err.
+func (h *Hedger) observe(method string, start time.Time, err error) error {
+	if err != nil || h.conf.Delay > 0 {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok := h.windows[method]
+	if !ok {
+		w = &latencyWindow{}
+		h.windows[method] = w
+	}
+	w.add(time.Since(start))
+	return nil
+}
+
+func (h *Hedger) count(counter *prometheus.CounterVec, method string) {
+	if counter != nil {
+		counter.With(prometheus.Labels{"target": h.target, "endpoint": method}).Inc()
+	}
+}
+
+// latencyWindow keeps the last latencies of a method, its p95 is updated
+// every few samples.
+type latencyWindow struct {
+	samples [hedgeSamples]time.Duration
+	n       int
+	next    int
+	p95     time.Duration
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % hedgeSamples
+	if w.n < hedgeSamples {
+		w.n++
+	}
+	if w.next%8 != 0 && w.n != hedgeMinSamples {
+		return
+	}
+
+	sorted := make([]float64, w.n)
+	for i := range sorted {
+		sorted[i] = float64(w.samples[i])
+	}
+	sort.Float64s(sorted)
+	w.p95 = time.Duration(sorted[w.n*95/100])
+}
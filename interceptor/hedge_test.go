@@ -0,0 +1,188 @@
+package interceptor
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+const checkMethod = "/grpc.health.v1.Health/Check"
+
+// healthFunc serves the health service by calling check.
+type healthFunc func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error)
+
+func (f healthFunc) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return f(ctx, req)
+}
+
+// startHealth serves check through the server interceptor, if any, and returns
+// a client calling it through the client interceptor.
+func startHealth(t *testing.T, check healthFunc, unary grpc.UnaryServerInterceptor, client grpc.UnaryClientInterceptor) (healthpb.HealthClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sopts []grpc.ServerOption
+	if unary != nil {
+		sopts = append(sopts, grpc.UnaryInterceptor(unary))
+	}
+	s := grpc.NewServer(sopts...)
+	healthpb.RegisterHealthServer(s, check)
+	go s.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return healthpb.NewHealthClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func newTestHedger() *Hedger {
+	return NewHedger("test", HedgeConf{
+		Delay:          20 * time.Millisecond,
+		BudgetRatio:    1,
+		BudgetCapacity: 10,
+		Idempotency:    NewIdempotencyRegistry(checkMethod),
+	})
+}
+
+func TestHedgerTrailerOfWinner(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	check := func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			grpc.SetTrailer(ctx, metadata.Pairs("copy", "slow"))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+		}
+		grpc.SetTrailer(ctx, metadata.Pairs("copy", "fast"))
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+	client, stop := startHealth(t, check, nil, newTestHedger().ClientHedging)
+	defer stop()
+
+	var header, trailer metadata.MD
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check = %v, want the response of the hedged copy", resp.Status)
+	}
+	// the canceled copy must not overwrite the trailer once returned.
+	time.Sleep(50 * time.Millisecond)
+	if got := trailer["copy"]; len(got) != 1 || got[0] != "fast" {
+		t.Errorf("trailer copy = %v, want [fast]", got)
+	}
+}
+
+// TestHedgerWithDeduplicator checks that the hedged copy waits for the call
+// in progress, and is processed once the call failed.
+func TestHedgerWithDeduplicator(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	check := func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			time.Sleep(100 * time.Millisecond)
+			return nil, grpc.Errorf(codes.Unavailable, "failed")
+		}
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	client, stop := startHealth(t, check, d.Dedup, newTestHedger().ClientHedging)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check = %v, want SERVING", resp.Status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Errorf("%d calls processed, want the hedged copy processed after the failure", calls)
+	}
+}
+
+// TestRetryWithDeduplicator checks that the retry of an attempt timed out
+// while in progress gets its response.
+func TestRetryWithDeduplicator(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	check := func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		time.Sleep(40 * time.Millisecond)
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+	}
+	d := NewDeduplicator(NewMemoryDedupStore(), time.Minute)
+	retry := UnaryClientRetry(
+		WithRetryMax(2),
+		WithPerRetryTimeout(30*time.Millisecond),
+		WithRetryBackoff(func(uint) time.Duration { return time.Millisecond }),
+		WithIdempotency(NewIdempotencyRegistry(checkMethod)),
+	)
+	client, stop := startHealth(t, check, d.Dedup, retry)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("%d calls processed, want the retry served from the first attempt", calls)
+	}
+}
+
+func TestNewHedgerWithoutIdempotency(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewHedger accepted a nil Idempotency")
+		}
+	}()
+	NewHedger("test", HedgeConf{Delay: time.Millisecond, BudgetRatio: 1, BudgetCapacity: 1})
+}
+
+// TestAfterCallType fails when the vendored grpc no longer matches the
+// reflection of the Hedger, see afterCallType.
+func TestAfterCallType(t *testing.T) {
+	if afterCallErr != nil {
+		t.Fatal(afterCallErr)
+	}
+}
@@ -0,0 +1,125 @@
+package interceptor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/eddyzhou/log"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+const (
+	// IdempotencyKeyMetadataKey identifies a logical call across its retries
+	// and hedged copies, see Deduplicator.
+	IdempotencyKeyMetadataKey = meta.IdempotencyKey
+)
+
+// IdempotencyRegistry tells which methods are safe to call more than once,
+// by full method name or glob, e.g. "/pkg.Service/Get*", or by a method option.
+type IdempotencyRegistry struct {
+	patterns []string
+	option   *proto.ExtensionDesc
+
+	mu          sync.Mutex
+	optionCache map[string]bool
+}
+
+func NewIdempotencyRegistry(patterns ...string) *IdempotencyRegistry {
+	return &IdempotencyRegistry{
+		patterns:    patterns,
+		optionCache: make(map[string]bool),
+	}
+}
+
+// SetOption marks as idempotent the methods whose option ext, a bool extension
+// of google.protobuf.MethodOptions, is true. The service must be declared in
+// the file of the request message. It must be called before calling.
+func (r *IdempotencyRegistry) SetOption(ext *proto.ExtensionDesc) {
+	r.option = ext
+}
+
+// IsIdempotent reports whether the method called with req is idempotent, a
+// nil registry knows none.
+func (r *IdempotencyRegistry) IsIdempotent(method string, req interface{}) bool {
+	if r == nil {
+		return false
+	}
+	for _, pattern := range r.patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	if r.option == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idempotent, ok := r.optionCache[method]
+	if !ok {
+		idempotent = r.optionSet(method, req)
+		r.optionCache[method] = idempotent
+	}
+	return idempotent
+}
+
+// optionSet looks for the option of method in the file of req.
+func (r *IdempotencyRegistry) optionSet(method string, req interface{}) bool {
+	dm, ok := req.(describedMessage)
+	if !ok {
+		return false
+	}
+	gz, _ := dm.Descriptor()
+	fd, err := fileDescriptor(gz)
+	if err != nil {
+		log.Warnf("idempotency option of %s ignored: %v", method, err)
+		return false
+	}
+
+	// method is "/package.Service/Method"
+	parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	if len(parts) != 2 {
+		return false
+	}
+	for _, sd := range fd.Service {
+		name := sd.GetName()
+		if fd.GetPackage() != "" {
+			name = fd.GetPackage() + "." + name
+		}
+		if name != parts[0] {
+			continue
+		}
+		for _, m := range sd.Method {
+			if m.GetName() != parts[1] || m.Options == nil {
+				continue
+			}
+			v, err := proto.GetExtension(m.Options, r.option)
+			if err != nil {
+				return false
+			}
+			b, ok := v.(*bool)
+			return ok && *b
+		}
+	}
+	return false
+}
+
+// withIdempotencyKey adds a new idempotency key to the outgoing metadata of
+// ctx, unless it has one already.
+func withIdempotencyKey(ctx context.Context) context.Context {
+	if _, ok := meta.GetOutgoing(ctx, IdempotencyKeyMetadataKey); ok {
+		return ctx
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Warnf("idempotency key not generated: %v", err)
+		return ctx
+	}
+	return meta.SetOutgoing(ctx, IdempotencyKeyMetadataKey, hex.EncodeToString(b))
+}
@@ -0,0 +1,188 @@
+package interceptor
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/ratelimit"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+// KeyFunc derives the key of the bucket limiting a call.
+type KeyFunc func(ctx context.Context, fullMethod string) string
+
+// MethodKey limits every method on its own.
+func MethodKey(ctx context.Context, fullMethod string) string {
+	return fullMethod
+}
+
+// MetadataKey limits every value of the metadata header key, e.g. the caller's app id.
+func MetadataKey(key string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		v, _ := meta.Get(ctx, key)
+		return v
+	}
+}
+
+// PeerKey limits every peer IP.
+func PeerKey(ctx context.Context, fullMethod string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// BucketConf configures a bucket, Quantum tokens are added every FillInterval,
+// up to Capacity.
+type BucketConf struct {
+	FillInterval time.Duration
+	Capacity     int64
+	Quantum      int64
+}
+
+func (c BucketConf) newBucket() *ratelimit.Bucket {
+	return ratelimit.NewBucketWithQuantum(c.FillInterval, c.Capacity, c.Quantum)
+}
+
+const (
+	defaultMaxKeys = 10000 // buckets of the keys without BucketConf, see SetMaxKeys
+)
+
+type keyedBucket struct {
+	key      string
+	bucket   *ratelimit.Bucket
+	lastUsed time.Time
+}
+
+// KeyedRateLimiter limits every key with its own bucket. The buckets of the
+// keys without BucketConf are evicted once idle for idleTimeout, and the
+// least recently used ones beyond maxKeys, so that memory stays bounded.
+type KeyedRateLimiter struct {
+	keyFunc     KeyFunc
+	defaultConf *BucketConf
+	idleTimeout time.Duration
+	maxKeys     int
+
+	mu      sync.Mutex
+	fixed   map[string]*ratelimit.Bucket // of the keys with BucketConf
+	buckets map[string]*list.Element     // of lru
+	lru     *list.List                   // *keyedBucket, the most recently used first
+}
+
+// NewKeyedRateLimiter uses confs for the listed keys and defaultConf for the
+// others, whose calls are not limited if defaultConf is nil. The buckets are
+// not evicted for idleness if idleTimeout <= 0, only beyond the maximum keys.
+func NewKeyedRateLimiter(keyFunc KeyFunc, defaultConf *BucketConf, confs map[string]BucketConf, idleTimeout time.Duration) *KeyedRateLimiter {
+	check := func(c BucketConf) {
+		if c.FillInterval <= 0 {
+			panic("xmiddleware/ratelimit: fill interval expects to be positive")
+		}
+		if c.Capacity < 1 {
+			panic("xmiddleware/ratelimit: capacity expects to be positive")
+		}
+		if c.Quantum < 1 {
+			panic("xmiddleware/ratelimit: quantum expects to be positive")
+		}
+	}
+	if defaultConf != nil {
+		check(*defaultConf)
+	}
+	for _, c := range confs {
+		check(c)
+	}
+
+	fixed := make(map[string]*ratelimit.Bucket, len(confs))
+	for k, c := range confs {
+		fixed[k] = c.newBucket()
+	}
+	return &KeyedRateLimiter{
+		keyFunc:     keyFunc,
+		defaultConf: defaultConf,
+		idleTimeout: idleTimeout,
+		maxKeys:     defaultMaxKeys,
+		fixed:       fixed,
+		buckets:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// SetMaxKeys bounds the buckets of the keys without BucketConf, 10000 by
+// default, evicting the least recently used. It must be called before serving.
+func (r *KeyedRateLimiter) SetMaxKeys(maxKeys int) {
+	if maxKeys < 1 {
+		panic("xmiddleware/ratelimit: maxKeys expects to be positive")
+	}
+	r.maxKeys = maxKeys
+}
+
+func (r *KeyedRateLimiter) RateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	if err := r.wait(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (r *KeyedRateLimiter) StreamRateLimit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := r.wait(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (r *KeyedRateLimiter) wait(ctx context.Context, fullMethod string) error {
+	bucket := r.bucket(r.keyFunc(ctx, fullMethod))
+	if bucket == nil {
+		return nil
+	}
+	return waitBucket(ctx, bucket)
+}
+
+func (r *KeyedRateLimiter) bucket(key string) *ratelimit.Bucket {
+	if b, ok := r.fixed[key]; ok {
+		return b
+	}
+	if r.defaultConf == nil {
+		return nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the idle buckets are the least recently used ones.
+	for e := r.lru.Back(); e != nil && r.idleTimeout > 0; e = r.lru.Back() {
+		if b := e.Value.(*keyedBucket); now.Sub(b.lastUsed) < r.idleTimeout {
+			break
+		}
+		r.evict(e)
+	}
+
+	if e, ok := r.buckets[key]; ok {
+		e.Value.(*keyedBucket).lastUsed = now
+		r.lru.MoveToFront(e)
+		return e.Value.(*keyedBucket).bucket
+	}
+	for r.lru.Len() >= r.maxKeys {
+		r.evict(r.lru.Back())
+	}
+	b := &keyedBucket{key: key, bucket: r.defaultConf.newBucket(), lastUsed: now}
+	r.buckets[key] = r.lru.PushFront(b)
+	return b.bucket
+}
+
+// evict drops the bucket of e, r.mu must be held.
+func (r *KeyedRateLimiter) evict(e *list.Element) {
+	r.lru.Remove(e)
+	delete(r.buckets, e.Value.(*keyedBucket).key)
+}
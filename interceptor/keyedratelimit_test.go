@@ -0,0 +1,52 @@
+package interceptor
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyedRateLimiterMaxKeys(t *testing.T) {
+	conf := &BucketConf{FillInterval: time.Second, Capacity: 1, Quantum: 1}
+	fixed := map[string]BucketConf{"fixed": *conf}
+	r := NewKeyedRateLimiter(MethodKey, conf, fixed, 0)
+	r.SetMaxKeys(3)
+
+	a := r.bucket("a")
+	b := r.bucket("b")
+	r.bucket("c")
+	r.bucket("a")
+	r.bucket("d") // evicts b, the least recently used
+	if r.bucket("a") != a {
+		t.Error("bucket of a evicted, want b")
+	}
+	if _, ok := r.buckets["b"]; ok {
+		t.Error("bucket of b kept beyond the maximum keys")
+	}
+
+	for i := 0; i < 100; i++ {
+		r.bucket("k" + strconv.Itoa(i))
+	}
+	if n := r.lru.Len(); n != 3 || len(r.buckets) != 3 {
+		t.Errorf("%d buckets, %d keys, want at most 3", n, len(r.buckets))
+	}
+	if r.bucket("fixed") != r.bucket("fixed") {
+		t.Error("bucket of a configured key evicted")
+	}
+	if r.bucket("b") == b {
+		t.Error("bucket of b reused after its eviction")
+	}
+}
+
+func TestKeyedRateLimiterIdle(t *testing.T) {
+	conf := &BucketConf{FillInterval: time.Second, Capacity: 1, Quantum: 1}
+	r := NewKeyedRateLimiter(MethodKey, conf, nil, 10*time.Millisecond)
+
+	r.bucket("a")
+	r.bucket("b")
+	time.Sleep(20 * time.Millisecond)
+	r.bucket("c")
+	if n := r.lru.Len(); n != 1 {
+		t.Errorf("%d buckets, want the idle ones evicted", n)
+	}
+}
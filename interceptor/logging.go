@@ -2,32 +2,550 @@ package interceptor
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eddyzhou/log"
+	"github.com/eddyzhou/ratelimit"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	pbdescriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+const (
+	RequestIDMetadataKey = meta.RequestID
+	// DebugMetadataKey forces the logging of a call when its value is true, e.g. "1".
+	DebugMetadataKey = meta.DebugLog
+
+	redacted = "[REDACTED]"
 )
 
 var (
 	js = &jsonpb.Marshaler{EnumsAsInts: true, EmitDefaults: true, OrigName: true}
+
+	defaultRequestLogger = NewRequestLogger()
 )
 
 // Logging interceptor for grpc
 func Logging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	start := time.Now()
+	return defaultRequestLogger.Logging(ctx, req, info, handler)
+}
+
+// StreamLogging interceptor for grpc stream
+func StreamLogging(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return defaultRequestLogger.StreamLogging(srv, ss, info, handler)
+}
+
+// ClientLogging interceptor for grpc client
+func ClientLogging(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return defaultRequestLogger.ClientLogging(ctx, method, req, reply, cc, invoker, opts...)
+}
+
+// StreamClientLogging interceptor for grpc client stream, it logs when the stream is established.
+func StreamClientLogging(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return defaultRequestLogger.StreamClientLogging(ctx, desc, cc, method, streamer, opts...)
+}
+
+// LevelFunc decides the log level of a finished call from its code.
+type LevelFunc func(code codes.Code) log.Level
+
+// DefaultLevelFunc logs OK at info, client-caused codes at warn and the others at error.
+func DefaultLevelFunc(code codes.Code) log.Level {
+	switch code {
+	case codes.OK:
+		return log.Linfo
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition,
+		codes.Aborted, codes.OutOfRange:
+		return log.Lwarn
+	default:
+		return log.Lerror
+	}
+}
+
+type LoggingOption func(*RequestLogger)
+
+// WithLogger sets the logger, log.Std by default.
+func WithLogger(logger *log.Logger) LoggingOption {
+	return func(l *RequestLogger) {
+		l.logger = logger
+	}
+}
+
+func WithLevelFunc(f LevelFunc) LoggingOption {
+	return func(l *RequestLogger) {
+		l.levelFunc = f
+	}
+}
+
+// WithPayloadMethods logs the payloads of these full methods only.
+func WithPayloadMethods(methods ...string) LoggingOption {
+	return func(l *RequestLogger) {
+		for _, m := range methods {
+			l.payloadAllow[m] = true
+		}
+	}
+}
+
+// WithoutPayloadMethods never logs the payloads of these full methods.
+func WithoutPayloadMethods(methods ...string) LoggingOption {
+	return func(l *RequestLogger) {
+		for _, m := range methods {
+			l.payloadDeny[m] = true
+		}
+	}
+}
+
+// WithMaxPayloadSize truncates the payloads longer than size bytes, 0 means no limit.
+func WithMaxPayloadSize(size int) LoggingOption {
+	return func(l *RequestLogger) {
+		l.maxPayloadSize = size
+	}
+}
+
+// WithRedactedFields redacts the proto fields with these names, wherever they are nested.
+func WithRedactedFields(names ...string) LoggingOption {
+	return func(l *RequestLogger) {
+		for _, n := range names {
+			l.redactFields[n] = true
+		}
+	}
+}
+
+// WithRedactOption redacts the proto fields marked by ext, a bool extension of
+// google.protobuf.FieldOptions, e.g. `string password = 1 [(sensitive) = true];`.
+func WithRedactOption(ext *proto.ExtensionDesc) LoggingOption {
+	return func(l *RequestLogger) {
+		l.redactOption = ext
+	}
+}
+
+// WithFailedOnly logs the failed calls, on top of the other modes.
+func WithFailedOnly() LoggingOption {
+	return func(l *RequestLogger) {
+		l.failedOnly = true
+	}
+}
+
+// WithSlowOnly logs the calls taking threshold or more, on top of the other modes.
+func WithSlowOnly(threshold time.Duration) LoggingOption {
+	return func(l *RequestLogger) {
+		l.slowThreshold = threshold
+	}
+}
+
+// WithSampleRate logs this fraction of the calls not selected by the other modes.
+func WithSampleRate(rate float64) LoggingOption {
+	return func(l *RequestLogger) {
+		l.sampleRate = rate
+	}
+}
+
+// WithSampleLimit logs at most perSecond calls per second of those not selected by the other modes.
+func WithSampleLimit(perSecond int64) LoggingOption {
+	return func(l *RequestLogger) {
+		if perSecond > 0 {
+			l.sampleBucket = ratelimit.NewBucketWithRate(float64(perSecond), perSecond)
+		}
+	}
+}
+
+type logDecisionKey struct{}
+
+type logDecision struct {
+	forced int32
+}
 
-	log.Printf("calling %s, req=%s", info.FullMethod, marshal(req))
+// ForceLogging makes the logging interceptor log the call of ctx whatever its
+// mode. It may be called from the interceptors and handlers on either side of it.
+func ForceLogging(ctx context.Context) context.Context {
+	if d, ok := ctx.Value(logDecisionKey{}).(*logDecision); ok {
+		atomic.StoreInt32(&d.forced, 1)
+		return ctx
+	}
+	return context.WithValue(ctx, logDecisionKey{}, &logDecision{forced: 1})
+}
+
+// IsLoggingForced reports whether ForceLogging was called for the call of ctx.
+func IsLoggingForced(ctx context.Context) bool {
+	d, ok := ctx.Value(logDecisionKey{}).(*logDecision)
+	return ok && atomic.LoadInt32(&d.forced) == 1
+}
+
+// RequestLogger logs one structured line per call. By default every call is
+// logged, the With*Only and WithSample* options restrict it to the selected ones.
+type RequestLogger struct {
+	logger         *log.Logger
+	levelFunc      LevelFunc
+	payloadAllow   map[string]bool
+	payloadDeny    map[string]bool
+	maxPayloadSize int
+	redactFields   map[string]bool
+	redactOption   *proto.ExtensionDesc
+
+	failedOnly    bool
+	slowThreshold time.Duration
+	sampleRate    float64
+	sampleBucket  *ratelimit.Bucket
+
+	mu          sync.Mutex
+	optionCache map[reflect.Type]map[string]bool
+}
+
+func NewRequestLogger(opts ...LoggingOption) *RequestLogger {
+	l := &RequestLogger{
+		logger:       log.Std,
+		levelFunc:    DefaultLevelFunc,
+		payloadAllow: make(map[string]bool),
+		payloadDeny:  make(map[string]bool),
+		redactFields: make(map[string]bool),
+		optionCache:  make(map[reflect.Type]map[string]bool),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+func (l *RequestLogger) Logging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	start := time.Now()
+	ctx = l.withDecision(ctx)
 	resp, err = handler(ctx, req)
-	log.Printf("finished %s, took=%v, resp=%v, err=%v", info.FullMethod, time.Since(start), resp, err)
+	if !l.shouldLog(ctx, start, err) {
+		return resp, err
+	}
+
+	fields := l.callFields(ctx, info.FullMethod, start, err)
+	fields = l.appendPayload(fields, info.FullMethod, "req", req)
+	fields = l.appendPayload(fields, info.FullMethod, "resp", resp)
+	l.log(grpc.Code(err), "finished unary call", fields)
 
 	return resp, err
 }
 
+func (l *RequestLogger) StreamLogging(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := l.withDecision(ss.Context())
+	err := handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	if !l.shouldLog(ctx, start, err) {
+		return err
+	}
+
+	fields := l.callFields(ctx, info.FullMethod, start, err)
+	fields = append(fields, "client_stream", fmt.Sprint(info.IsClientStream), "server_stream", fmt.Sprint(info.IsServerStream))
+	l.log(grpc.Code(err), "finished stream call", fields)
+
+	return err
+}
+
+func (l *RequestLogger) ClientLogging(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	ctx = l.withDecision(ctx)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if !l.shouldLog(ctx, start, err) {
+		return err
+	}
+
+	fields := l.callFields(ctx, method, start, err)
+	fields = l.appendPayload(fields, method, "req", req)
+	if err == nil {
+		fields = l.appendPayload(fields, method, "reply", reply)
+	}
+	l.log(grpc.Code(err), "finished client unary call", fields)
+
+	return err
+}
+
+func (l *RequestLogger) StreamClientLogging(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	ctx = l.withDecision(ctx)
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if !l.shouldLog(ctx, start, err) {
+		return cs, err
+	}
+
+	fields := l.callFields(ctx, method, start, err)
+	fields = append(fields, "client_stream", fmt.Sprint(desc.ClientStreams), "server_stream", fmt.Sprint(desc.ServerStreams))
+	l.log(grpc.Code(err), "opened client stream", fields)
+
+	return cs, err
+}
+
+// withDecision attaches the decision that ForceLogging flips, forced already
+// if the incoming metadata carries DebugMetadataKey.
+func (l *RequestLogger) withDecision(ctx context.Context) context.Context {
+	if debug, ok := meta.GetBool(ctx, DebugMetadataKey); ok && debug {
+		return ForceLogging(ctx)
+	}
+	if _, ok := ctx.Value(logDecisionKey{}).(*logDecision); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, logDecisionKey{}, &logDecision{})
+}
+
+func (l *RequestLogger) shouldLog(ctx context.Context, start time.Time, err error) bool {
+	if IsLoggingForced(ctx) {
+		return true
+	}
+	if !l.failedOnly && l.slowThreshold <= 0 && l.sampleRate <= 0 && l.sampleBucket == nil {
+		return true
+	}
+	if l.failedOnly && err != nil {
+		return true
+	}
+	if l.slowThreshold > 0 && time.Since(start) >= l.slowThreshold {
+		return true
+	}
+	if l.sampleRate <= 0 && l.sampleBucket == nil {
+		return false
+	}
+	if l.sampleRate > 0 && rand.Float64() >= l.sampleRate {
+		return false
+	}
+	return l.sampleBucket == nil || l.sampleBucket.TakeAvailable(1) == 1
+}
+
+func (l *RequestLogger) callFields(ctx context.Context, method string, start time.Time, err error) []string {
+	fields := []string{
+		"method", method,
+		"code", grpc.Code(err).String(),
+		"duration", time.Since(start).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields = append(fields, "peer", p.Addr.String())
+	}
+	if id, ok := requestID(ctx); ok {
+		fields = append(fields, "request_id", id)
+	}
+	if attempt, ok := meta.Get(ctx, AttemptMetadataKey); ok {
+		fields = append(fields, "attempt", attempt)
+	}
+	if err != nil {
+		fields = append(fields, "err", grpc.ErrorDesc(err))
+	}
+	return fields
+}
+
+func (l *RequestLogger) appendPayload(fields []string, method string, key string, x interface{}) []string {
+	if !l.logPayload(method) {
+		return fields
+	}
+	s := l.marshal(x)
+	if l.maxPayloadSize > 0 && len(s) > l.maxPayloadSize {
+		s = s[:l.maxPayloadSize] + "...(truncated)"
+	}
+	return append(fields, key, s)
+}
+
+func (l *RequestLogger) logPayload(method string) bool {
+	if l.payloadDeny[method] {
+		return false
+	}
+	return len(l.payloadAllow) == 0 || l.payloadAllow[method]
+}
+
+func (l *RequestLogger) log(code codes.Code, msg string, fields []string) {
+	line := msg + " " + formatFields(fields)
+	switch l.levelFunc(code) {
+	case log.Ldebug:
+		l.logger.Debug(line)
+	case log.Linfo:
+		l.logger.Info(line)
+	case log.Lwarn:
+		l.logger.Warn(line)
+	default:
+		l.logger.Error(line)
+	}
+}
+
+// marshal is like the package marshal, with the sensitive fields redacted.
+func (l *RequestLogger) marshal(x interface{}) string {
+	pb, ok := x.(proto.Message)
+	if !ok || x == nil || reflect.ValueOf(x).IsNil() {
+		return marshal(x)
+	}
+	names := l.sensitiveFields(pb)
+	if len(names) == 0 {
+		return marshal(x)
+	}
+
+	var buf bytes.Buffer
+	if err := js.Marshal(&buf, pb); err != nil {
+		return fmt.Sprintf("Marshal to json error: %s", err.Error())
+	}
+	var v interface{}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Sprintf("Marshal to json error: %s", err.Error())
+	}
+	b, err := json.Marshal(redact(v, names))
+	if err != nil {
+		return fmt.Sprintf("Marshal to json error: %s", err.Error())
+	}
+	return string(b)
+}
+
+func (l *RequestLogger) sensitiveFields(pb proto.Message) map[string]bool {
+	if l.redactOption == nil {
+		return l.redactFields
+	}
+
+	t := reflect.TypeOf(pb)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if names, ok := l.optionCache[t]; ok {
+		return names
+	}
+	names := make(map[string]bool, len(l.redactFields))
+	for n := range l.redactFields {
+		names[n] = true
+	}
+	collectOptionFields(pb, l.redactOption, names, make(map[string]bool))
+	l.optionCache[t] = names
+	return names
+}
+
+// collectOptionFields adds the names of the fields of pb and its nested
+// messages which are marked by ext.
+func collectOptionFields(pb proto.Message, ext *proto.ExtensionDesc, names map[string]bool, seen map[string]bool) {
+	dm, ok := pb.(describedMessage)
+	if !ok || seen[proto.MessageName(pb)] {
+		return
+	}
+	seen[proto.MessageName(pb)] = true
+
+	md, err := messageDescriptor(dm)
+	if err != nil {
+		log.Warnf("redact option of %s ignored: %v", proto.MessageName(pb), err)
+		return
+	}
+	for _, f := range md.Field {
+		if f.Options != nil {
+			if v, err := proto.GetExtension(f.Options, ext); err == nil {
+				if b, ok := v.(*bool); ok && *b {
+					names[f.GetName()] = true
+				}
+			}
+		}
+		if f.GetTypeName() == "" {
+			continue
+		}
+		t := proto.MessageType(strings.TrimPrefix(f.GetTypeName(), "."))
+		if t == nil || t.Kind() != reflect.Ptr {
+			continue
+		}
+		if nested, ok := reflect.New(t.Elem()).Interface().(proto.Message); ok {
+			collectOptionFields(nested, ext, names, seen)
+		}
+	}
+}
+
+// describedMessage is satisfied by the messages generated by protoc-gen-go.
+type describedMessage interface {
+	proto.Message
+	Descriptor() ([]byte, []int)
+}
+
+func messageDescriptor(dm describedMessage) (*pbdescriptor.DescriptorProto, error) {
+	gz, path := dm.Descriptor()
+	fd, err := fileDescriptor(gz)
+	if err != nil {
+		return nil, err
+	}
+	md := fd.MessageType[path[0]]
+	for _, i := range path[1:] {
+		md = md.NestedType[i]
+	}
+	return md, nil
+}
+
+// fileDescriptor decodes the gzipped FileDescriptorProto registered by protoc-gen-go.
+func fileDescriptor(gz []byte) (*pbdescriptor.FileDescriptorProto, error) {
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := new(pbdescriptor.FileDescriptorProto)
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func redact(v interface{}, names map[string]bool) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, e := range vv {
+			if names[k] {
+				vv[k] = redacted
+			} else {
+				vv[k] = redact(e, names)
+			}
+		}
+	case []interface{}:
+		for i, e := range vv {
+			vv[i] = redact(e, names)
+		}
+	}
+	return v
+}
+
+// contextServerStream overrides the context of a grpc.ServerStream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func requestID(ctx context.Context) (string, bool) {
+	if id, ok := meta.Get(ctx, RequestIDMetadataKey); ok {
+		return id, true
+	}
+	return meta.GetOutgoing(ctx, RequestIDMetadataKey)
+}
+
+// formatFields formats key/value pairs as logfmt.
+func formatFields(fields []string) string {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fields[i])
+		buf.WriteByte('=')
+		v := fields[i+1]
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		buf.WriteString(v)
+	}
+	return buf.String()
+}
+
 // marshal converts a protocol buffer object to JSON string.
 func marshal(x interface{}) string {
 	if x == nil || reflect.ValueOf(x).IsNil() {
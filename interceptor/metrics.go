@@ -0,0 +1,32 @@
+package interceptor
+
+import (
+	"github.com/eddyzhou/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// register registers c with registerer, or returns the equal collector which
+// is already registered, so that several monitors can share the metrics.
+func register(registerer prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// registerInstance registers c, which reads the state of a single instance.
+// If an equal collector is registered already, c is skipped rather than shown
+// as the other instance: the instances sharing a registerer must be told apart
+// by the server label to be exported.
+func registerInstance(registerer prometheus.Registerer, c prometheus.Collector) {
+	if err := registerer.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			log.Warnf("xmiddleware/metrics: %v, not exported, the servers sharing a registerer expect distinct names", err)
+			return
+		}
+		panic(err)
+	}
+}
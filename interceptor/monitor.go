@@ -1,19 +1,19 @@
 package interceptor
 
 import (
-	"errors"
-	"fmt"
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/eddyzhou/log"
-	"github.com/getsentry/raven-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
 )
 
 const (
@@ -22,23 +22,44 @@ const (
 
 var (
 	defaultBuckets = []float64{10, 20, 30, 50, 80, 100, 200, 300, 500, 1000, 2000, 3000}
+
+	// DefaultErrorCodes are the codes counted as server errors, the others are
+	// considered as outcomes caused by the client.
+	DefaultErrorCodes = []codes.Code{
+		codes.Unknown, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unimplemented,
+		codes.Internal, codes.Unavailable, codes.DataLoss,
+	}
 )
 
 type Monitor struct {
-	sentryClient *raven.Client
+	reporter     ErrorReporter
 	reqCounter   *prometheus.CounterVec
 	errCounter   *prometheus.CounterVec
+	retryCounter *prometheus.CounterVec
 	respLatency  *prometheus.HistogramVec
+	errorCodes   map[codes.Code]bool
+	panics       uint64
 }
 
-func NewMonitor(application string, port int, sentryDSN string, buckets ...float64) (*Monitor, error) {
+// NewMonitor reports errors to sentry, or only logs them if sentryDSN is empty.
+// The metrics are registered with registerer, prometheus.DefaultRegisterer if nil.
+func NewMonitor(application string, port int, sentryDSN string, registerer prometheus.Registerer, buckets ...float64) (*Monitor, error) {
 	var m Monitor
-	client, err := raven.New(sentryDSN)
-	if err != nil {
-		log.Error("Monitor: init failed: ", err.Error())
-		return nil, err
+	if sentryDSN == "" {
+		m.reporter = NewLogReporter()
+	} else {
+		reporter, err := NewSentryReporter(sentryDSN)
+		if err != nil {
+			log.Error("Monitor: init failed: ", err.Error())
+			return nil, err
+		}
+		m.reporter = reporter
+	}
+	m.SetErrorCodes(DefaultErrorCodes...)
+
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
 	}
-	m.sentryClient = client
 
 	process := strconv.Itoa(port)
 	m.reqCounter = prometheus.NewCounterVec(
@@ -49,10 +70,10 @@ func NewMonitor(application string, port int, sentryDSN string, buckets ...float
 			ConstLabels: prometheus.Labels{"method": "rpc", "process": process},
 		},
 		[]string{
-			"endpoint",
+			"endpoint", "code",
 		},
 	)
-	prometheus.MustRegister(m.reqCounter)
+	m.reqCounter = register(registerer, m.reqCounter).(*prometheus.CounterVec)
 
 	m.errCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -62,10 +83,23 @@ func NewMonitor(application string, port int, sentryDSN string, buckets ...float
 			ConstLabels: prometheus.Labels{"method": "rpc", "process": process},
 		},
 		[]string{
-			"endpoint",
+			"endpoint", "code",
 		},
 	)
-	prometheus.MustRegister(m.errCounter)
+	m.errCounter = register(registerer, m.errCounter).(*prometheus.CounterVec)
+
+	m.retryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "retry_requests_total",
+			Help:        "Total request counts retried by the client",
+			ConstLabels: prometheus.Labels{"method": "rpc", "process": process},
+		},
+		[]string{
+			"endpoint", "code",
+		},
+	)
+	m.retryCounter = register(registerer, m.retryCounter).(*prometheus.CounterVec)
 
 	if len(buckets) == 0 {
 		buckets = defaultBuckets
@@ -79,69 +113,135 @@ func NewMonitor(application string, port int, sentryDSN string, buckets ...float
 			Buckets:     buckets,
 		},
 		[]string{
-			"endpoint",
+			"endpoint", "code",
 		},
 	)
-	prometheus.MustRegister(m.respLatency)
+	m.respLatency = register(registerer, m.respLatency).(*prometheus.HistogramVec)
 
 	return &m, nil
 }
 
-func (m *Monitor) Observe(method string, latency float64) {
-	labels := prometheus.Labels{"endpoint": method}
+// SetErrorCodes replaces the codes counted by error_total, it must be called before serving.
+func (m *Monitor) SetErrorCodes(cs ...codes.Code) {
+	m.errorCodes = make(map[codes.Code]bool, len(cs))
+	for _, c := range cs {
+		m.errorCodes[c] = true
+	}
+}
+
+// SetReporter replaces the reporter of errors, it must be called before serving.
+func (m *Monitor) SetReporter(reporter ErrorReporter) {
+	m.reporter = reporter
+}
+
+// Panics returns the number of panics recovered so far.
+func (m *Monitor) Panics() uint64 {
+	return atomic.LoadUint64(&m.panics)
+}
+
+// Flush blocks until the pending error reports are sent.
+func (m *Monitor) Flush() {
+	if fl, ok := m.reporter.(Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (m *Monitor) IsError(code codes.Code) bool {
+	return m.errorCodes[code]
+}
+
+func (m *Monitor) Observe(method string, code codes.Code, latency float64) {
+	labels := prometheus.Labels{"endpoint": method, "code": code.String()}
 	m.reqCounter.With(labels).Inc()
 	m.respLatency.With(labels).Observe(latency)
 }
 
-func (m *Monitor) ObserveError(method string, err error) {
-	labels := prometheus.Labels{"endpoint": method}
+// ObserveError counts and reports err if its code is an error, client-caused outcomes are ignored.
+// Panics caught by Recovery are always reported.
+func (m *Monitor) ObserveError(ctx context.Context, method string, err error) {
+	m.observeError(ctx, method, err, "")
+}
+
+func (m *Monitor) observeError(ctx context.Context, method string, err error, stack string) {
+	code := grpc.Code(err)
+	if !m.IsError(code) && stack == "" {
+		return
+	}
+	labels := prometheus.Labels{"endpoint": method, "code": code.String()}
 	m.errCounter.With(labels).Inc()
 
-	m.sentryClient.CaptureError(err, nil)
+	m.reporter.Report(newErrorReport(ctx, method, err, stack))
 }
 
 func (m *Monitor) Monitoring(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 	start := time.Now()
 	resp, err = handler(ctx, req)
-	if err == nil {
-		m.Observe(info.FullMethod, float64(time.Since(start).Nanoseconds())/1000000)
-	} else {
-		m.ObserveError(info.FullMethod, err)
-	}
+	m.observeCall(ctx, info.FullMethod, start, err)
 
 	return resp, err
 }
 
+func (m *Monitor) StreamMonitoring(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.observeCall(ss.Context(), info.FullMethod, start, err)
+
+	return err
+}
+
+func (m *Monitor) observeCall(ctx context.Context, method string, start time.Time, err error) {
+	m.Observe(method, grpc.Code(err), sinceMillisecond(start))
+	if _, ok := meta.Get(ctx, AttemptMetadataKey); ok {
+		m.retryCounter.With(prometheus.Labels{"endpoint": method, "code": grpc.Code(err).String()}).Inc()
+	}
+	if err != nil {
+		m.ObserveError(ctx, method, err)
+	}
+}
+
 // Recovery interceptor to handle grpc panic
 func (m *Monitor) Recovery(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	// recovery func
 	defer func() {
 		if r := recover(); r != nil {
-			// log stack
-			stack := make([]byte, MAXSTACKSIZE)
-			stack = stack[:runtime.Stack(stack, false)]
-			errStack := string(stack)
-			log.Errorf("panic grpc invoke: %s, err=%v, stack:\n%s", info.FullMethod, r, errStack)
-
-			func() {
-				defer func() {
-					if r := recover(); err != nil {
-						log.Errorf("report sentry failed: %s, trace:\n%s", r, debug.Stack())
-						err = grpc.Errorf(codes.Internal, "panic error: %v", r)
-					}
-				}()
-				switch rval := r.(type) {
-				case error:
-					m.ObserveError(info.FullMethod, rval)
-				default:
-					m.ObserveError(info.FullMethod, errors.New(fmt.Sprint(rval)))
-				}
-			}()
-
-			// if panic, set custom error to 'err', in order that client and sense it.
-			err = grpc.Errorf(codes.Internal, "panic error: %v", r)
+			err = m.handlePanic(ctx, info.FullMethod, r)
 		}
 	}()
 
 	return handler(ctx, req)
 }
+
+// StreamRecovery interceptor to handle grpc stream panic
+func (m *Monitor) StreamRecovery(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = m.handlePanic(ss.Context(), info.FullMethod, r)
+		}
+	}()
+
+	return handler(srv, ss)
+}
+
+// handlePanic logs and reports the recovered value r, returning the error sent to the client.
+func (m *Monitor) handlePanic(ctx context.Context, method string, r interface{}) (err error) {
+	atomic.AddUint64(&m.panics, 1)
+
+	// log stack
+	stack := make([]byte, MAXSTACKSIZE)
+	stack = stack[:runtime.Stack(stack, false)]
+	errStack := string(stack)
+	log.Errorf("panic grpc invoke: %s, err=%v, stack:\n%s", method, r, errStack)
+
+	// if panic, set custom error to 'err', in order that client and sense it.
+	err = grpc.Errorf(codes.Internal, "panic error: %v", r)
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("report error failed: %s, trace:\n%s", r, debug.Stack())
+			}
+		}()
+		m.observeError(ctx, method, err, errStack)
+	}()
+
+	return err
+}
@@ -0,0 +1,79 @@
+package interceptor
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+const (
+	// PriorityMetadataKey carries the priority of a call, see ParsePriority.
+	PriorityMetadataKey = meta.Priority
+)
+
+// Priority of a call, the lower the more important.
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityNormal
+	PrioritySheddable
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityNormal:
+		return "normal"
+	case PrioritySheddable:
+		return "sheddable"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePriority parses "critical", "normal" or "sheddable".
+func ParsePriority(s string) (Priority, bool) {
+	switch strings.ToLower(s) {
+	case "critical":
+		return PriorityCritical, true
+	case "normal":
+		return PriorityNormal, true
+	case "sheddable":
+		return PrioritySheddable, true
+	default:
+		return PriorityNormal, false
+	}
+}
+
+// PriorityFunc classifies a call.
+type PriorityFunc func(ctx context.Context, fullMethod string) Priority
+
+// PriorityPattern gives Priority to the full methods matching the glob Pattern,
+// e.g. "/grpc.health.v1.Health/*".
+type PriorityPattern struct {
+	Pattern  string
+	Priority Priority
+}
+
+// NewPriorityFunc classifies by the first pattern matching the full method, else
+// by the PriorityMetadataKey header, else as def.
+func NewPriorityFunc(def Priority, patterns ...PriorityPattern) PriorityFunc {
+	return func(ctx context.Context, fullMethod string) Priority {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p.Pattern, fullMethod); ok {
+				return p.Priority
+			}
+		}
+		if v, ok := meta.Get(ctx, PriorityMetadataKey); ok {
+			if p, ok := ParsePriority(v); ok {
+				return p
+			}
+		}
+		return def
+	}
+}
@@ -0,0 +1,270 @@
+package interceptor
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	quotaMinBackoff = 100 * time.Millisecond // before calling the backend again after a failure
+	quotaMaxBackoff = 5 * time.Second
+)
+
+// QuotaBackend counts the tokens taken cluster-wide, in fixed windows.
+type QuotaBackend interface {
+	// Take adds n to the counter of key, which expires after ttl, and
+	// returns the counter including n. It gives up when ctx is done.
+	Take(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+}
+
+// ------------- memory
+
+type memoryCounter struct {
+	n       int64
+	expires time.Time
+}
+
+type memoryBackend struct {
+	mu       sync.Mutex
+	counters map[string]*memoryCounter
+}
+
+// NewMemoryBackend returns a QuotaBackend local to the process, standing in
+// for a shared one in tests and development.
+func NewMemoryBackend() QuotaBackend {
+	return &memoryBackend{counters: make(map[string]*memoryCounter)}
+}
+
+func (m *memoryBackend) Take(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, c := range m.counters {
+		if !now.Before(c.expires) {
+			delete(m.counters, k)
+		}
+	}
+	c, ok := m.counters[key]
+	if !ok {
+		c = &memoryCounter{}
+		m.counters[key] = c
+	}
+	c.n += n
+	c.expires = now.Add(ttl)
+	return c.n, nil
+}
+
+// ------------- distributed quota
+
+// distributedQuota allows limit tokens per window across the cluster. With a
+// sync interval, the tokens are counted locally and pushed to the backend
+// periodically, instead of on every call. Without, the backend is not called
+// for a while after it failed, backing off up to quotaMaxBackoff.
+type distributedQuota struct {
+	backend      QuotaBackend
+	key          string
+	window       time.Duration
+	limit        int64 // accessed atomically
+	syncInterval time.Duration
+
+	mu          sync.Mutex
+	windowIndex int64
+	known       int64 // cluster-wide count of the window at the last sync
+	pending     int64 // local count not pushed yet
+	unreachable bool
+	retryAt     time.Time     // next call to the backend while unreachable, without sync
+	backoff     time.Duration // since the last failure, without sync
+	quit        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newDistributedQuota(backend QuotaBackend, key string, window time.Duration, limit int64, syncInterval time.Duration) *distributedQuota {
+	q := &distributedQuota{
+		backend:      backend,
+		key:          key,
+		window:       window,
+		limit:        limit,
+		syncInterval: syncInterval,
+		quit:         make(chan struct{}),
+	}
+	if syncInterval > 0 {
+		go q.syncLoop()
+	}
+	return q
+}
+
+// take reports whether a token is available in the current window, and if
+// not, how long until the next one. err is set when the backend is unreachable.
+func (q *distributedQuota) take(ctx context.Context) (bool, time.Duration, error) {
+	now := time.Now()
+	index := now.UnixNano() / int64(q.window)
+	untilNext := time.Duration((index+1)*int64(q.window) - now.UnixNano())
+
+	if q.syncInterval <= 0 {
+		if !q.probe(now) {
+			return false, 0, errQuotaUnreachable
+		}
+		n, err := q.backend.Take(ctx, q.windowKey(index), 1, q.window)
+		if err != nil && ctx.Err() != nil {
+			return false, 0, ctx.Err()
+		}
+		q.result(err)
+		if err != nil {
+			return false, 0, err
+		}
+		return n <= atomic.LoadInt64(&q.limit), untilNext, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.unreachable {
+		return false, 0, errQuotaUnreachable
+	}
+	if index != q.windowIndex {
+		q.windowIndex, q.known, q.pending = index, 0, 0
+	}
+	if q.known+q.pending >= atomic.LoadInt64(&q.limit) {
+		return false, untilNext, nil
+	}
+	q.pending++
+	return true, 0, nil
+}
+
+// probe reports whether the backend may be called, only one call is let
+// through once the backoff after a failure is over.
+func (q *distributedQuota) probe(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.unreachable {
+		return true
+	}
+	if now.Before(q.retryAt) {
+		return false
+	}
+	q.retryAt = now.Add(q.backoff)
+	return true
+}
+
+// result records the outcome of a call to the backend, without sync.
+func (q *distributedQuota) result(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil {
+		if q.unreachable {
+			log.Info("quota backend reachable again")
+		}
+		q.unreachable, q.backoff = false, 0
+		return
+	}
+	if !q.unreachable {
+		log.Warnf("quota backend unreachable, falling back to the local bucket: %v", err)
+	}
+	q.unreachable = true
+	q.backoff *= 2
+	if q.backoff < quotaMinBackoff {
+		q.backoff = quotaMinBackoff
+	}
+	if q.backoff > quotaMaxBackoff {
+		q.backoff = quotaMaxBackoff
+	}
+	q.retryAt = time.Now().Add(q.backoff)
+}
+
+func (q *distributedQuota) setLimit(limit int64) {
+	atomic.StoreInt64(&q.limit, limit)
+}
+
+func (q *distributedQuota) windowKey(index int64) string {
+	return fmt.Sprintf("%s:%d", q.key, index)
+}
+
+func (q *distributedQuota) syncLoop() {
+	ticker := time.NewTicker(q.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.sync()
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// stop stops pushing the local count to the backend.
+func (q *distributedQuota) stop() {
+	q.stopOnce.Do(func() {
+		close(q.quit)
+	})
+}
+
+func (q *distributedQuota) sync() {
+	q.mu.Lock()
+	index, delta := q.windowIndex, q.pending
+	if index != time.Now().UnixNano()/int64(q.window) {
+		// the window is over, nothing in it matters anymore.
+		index, delta = time.Now().UnixNano()/int64(q.window), 0
+	}
+	q.pending = 0
+	q.mu.Unlock()
+
+	n, err := q.backend.Take(context.Background(), q.windowKey(index), delta, q.window)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		if !q.unreachable {
+			log.Warnf("quota backend unreachable, falling back to the local bucket: %v", err)
+		}
+		q.unreachable = true
+		return
+	}
+	if q.unreachable {
+		log.Info("quota backend reachable again")
+	}
+	q.unreachable = false
+	if q.windowIndex != index {
+		q.windowIndex, q.pending = index, 0
+	}
+	q.known = n
+}
+
+// wait takes a token, waiting for the next windows up to maxWait, or
+// forever if maxWait is negative, unless ctx is done first.
+func (q *distributedQuota) wait(ctx context.Context, maxWait time.Duration) (retryAfter time.Duration, err error) {
+	var waited time.Duration
+	for {
+		ok, untilNext, err := q.take(ctx)
+		if err != nil || ok {
+			return 0, err
+		}
+		if maxWait >= 0 && waited+untilNext > maxWait {
+			return untilNext, errQuotaExceeded
+		}
+		if err := sleep(ctx, untilNext); err != nil {
+			return 0, err
+		}
+		waited += untilNext
+	}
+}
+
+var (
+	errQuotaExceeded    = fmt.Errorf("xmiddleware/ratelimit: quota exceeded")
+	errQuotaUnreachable = fmt.Errorf("xmiddleware/ratelimit: quota backend unreachable")
+)
+
+// windowLimit converts rate, in tokens per second, to a limit per window, at least 1.
+func windowLimit(rate float64, window time.Duration) int64 {
+	limit := int64(math.Ceil(rate * window.Seconds()))
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
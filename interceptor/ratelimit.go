@@ -1,15 +1,30 @@
 package interceptor
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eddyzhou/log"
 	"github.com/eddyzhou/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
+var errDeadlineTooShort = grpc.Errorf(codes.DeadlineExceeded, "Deadline too short to be served")
+
 type RateLimiter struct {
-	bucket *ratelimit.Bucket
+	mu      sync.RWMutex
+	bucket  *ratelimit.Bucket
+	reject  bool
+	maxWait time.Duration
+	quota   *distributedQuota
+
+	minProcessing    time.Duration
+	deadlineRejected uint64
 }
 
 func NewRateLimiter(fillInterval time.Duration, capacity int64, quantum int64) *RateLimiter {
@@ -25,18 +40,216 @@ func NewRateLimiter(fillInterval time.Duration, capacity int64, quantum int64) *
 	}
 }
 
+// SetRate changes the rate while serving, the new bucket starts full. The
+// cluster-wide quota, if any, follows the new rate.
+func (r *RateLimiter) SetRate(fillInterval time.Duration, capacity int64, quantum int64) error {
+	if fillInterval <= 0 {
+		return fmt.Errorf("xmiddleware/ratelimit: fillInterval expects to be positive, got %v", fillInterval)
+	}
+	if capacity < 1 {
+		return fmt.Errorf("xmiddleware/ratelimit: capacity expects to be positive, got %d", capacity)
+	}
+	if quantum < 1 {
+		return fmt.Errorf("xmiddleware/ratelimit: quantum expects to be positive, got %d", quantum)
+	}
+
+	bucket := ratelimit.NewBucketWithQuantum(fillInterval, capacity, quantum)
+	r.mu.Lock()
+	log.Infof("rate limit: rate %.1f/s -> %.1f/s, capacity %d -> %d",
+		r.bucket.Rate(), bucket.Rate(), r.bucket.Capacity(), capacity)
+	r.bucket = bucket
+	r.mu.Unlock()
+	if r.quota != nil {
+		r.quota.setLimit(windowLimit(bucket.Rate(), r.quota.window))
+	}
+	return nil
+}
+
+func (r *RateLimiter) currentBucket() *ratelimit.Bucket {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bucket
+}
+
+// SetMaxWait makes the rate limiter reject with ResourceExhausted, instead of
+// waiting, when the wait would exceed maxWait or the remaining deadline. The
+// error carries the retry delay, see RetryAfter. It must be called before serving.
+func (r *RateLimiter) SetMaxWait(maxWait time.Duration) {
+	r.reject = true
+	r.maxWait = maxWait
+}
+
+// SetBackend makes the rate of the limiter cluster-wide, counted through backend
+// under key in windows of one second. Every call takes from the backend, unless
+// syncInterval is positive, then the calls are counted locally and pushed every
+// syncInterval. While the backend is unreachable, the local bucket limits each
+// process on its own, as without backend. It must be called before serving.
+func (r *RateLimiter) SetBackend(backend QuotaBackend, key string, syncInterval time.Duration) {
+	window := time.Second
+	limit := windowLimit(r.currentBucket().Rate(), window)
+	r.quota = newDistributedQuota(backend, key, window, limit, syncInterval)
+}
+
+// Stop stops pushing the calls counted locally to the backend, see SetBackend.
+func (r *RateLimiter) Stop() {
+	if r.quota != nil {
+		r.quota.stop()
+	}
+}
+
+// SetMinProcessing rejects with DeadlineExceeded, without waiting, the calls
+// whose deadline would leave less than minProcessing to be served after their
+// wait for a token. It must be called before serving.
+func (r *RateLimiter) SetMinProcessing(minProcessing time.Duration) {
+	r.minProcessing = minProcessing
+}
+
+// DeadlineRejected returns the number of calls rejected for a too short
+// deadline by RateLimit and StreamRateLimit.
+func (r *RateLimiter) DeadlineRejected() uint64 {
+	return atomic.LoadUint64(&r.deadlineRejected)
+}
+
+// RegisterMetrics exports the calls rejected for a too short deadline,
+// labelled with server. It is not exported if a rate limiter of the same
+// server is registered already.
+func (r *RateLimiter) RegisterMetrics(application string, server string, registerer prometheus.Registerer) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	registerInstance(registerer, prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "ratelimit_deadline_rejected_total",
+			Help:        "Calls rejected by the rate limiter for a deadline too short to be served",
+			ConstLabels: prometheus.Labels{"server": server},
+		},
+		func() float64 { return float64(r.DeadlineRejected()) },
+	))
+}
+
 func (r *RateLimiter) RateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	t := r.bucket.Take(1)
+	if err := r.serverWait(ctx); err != nil {
+		setPushback(ctx, err)
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (r *RateLimiter) StreamRateLimit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := r.serverWait(ss.Context()); err != nil {
+		setStreamPushback(ss, err)
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (r *RateLimiter) ClientRateLimit(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := r.clientWait(ctx); err != nil {
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (r *RateLimiter) StreamClientRateLimit(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if err := r.clientWait(ctx); err != nil {
+		return nil, err
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// serverWait waits for a token, counting the calls rejected for their deadline.
+func (r *RateLimiter) serverWait(ctx context.Context) error {
+	err := r.wait(ctx)
+	if err == errDeadlineTooShort {
+		atomic.AddUint64(&r.deadlineRejected, 1)
+	}
+	return err
+}
+
+// clientWait waits for a token, converting the errors of ctx to gRPC errors.
+func (r *RateLimiter) clientWait(ctx context.Context) error {
+	err := r.wait(ctx)
+	if err != nil && err == ctx.Err() {
+		return convToGrpcErr(err)
+	}
+	return err
+}
+
+// wait waits for a token, for at most maxWait in reject mode, and never longer
+// than the deadline of ctx leaves before minProcessing.
+func (r *RateLimiter) wait(ctx context.Context) error {
+	maxWait := time.Duration(-1)
+	if r.reject {
+		maxWait = r.maxWait
+	}
+	deadlineBound := false
+	if budget, ok := waitBudget(ctx, r.minProcessing); ok {
+		if budget < 0 {
+			return errDeadlineTooShort
+		}
+		if maxWait < 0 || budget < maxWait {
+			maxWait, deadlineBound = budget, true
+		}
+	}
+
+	if r.quota != nil {
+		retryAfter, err := r.quota.wait(ctx, maxWait)
+		switch {
+		case err == nil:
+			return nil
+		case err == errQuotaExceeded && deadlineBound:
+			return errDeadlineTooShort
+		case err == errQuotaExceeded:
+			return overloaded(retryAfter, "Rate limit exceeded")
+		case err == ctx.Err():
+			return err
+		}
+		// the backend is unreachable, fall back to the local bucket.
+	}
+
+	bucket := r.currentBucket()
+	if maxWait < 0 {
+		return waitBucket(ctx, bucket)
+	}
+	t, ok := bucket.TakeMaxDuration(1, maxWait)
+	if !ok && deadlineBound {
+		return errDeadlineTooShort
+	}
+	if !ok {
+		retryAfter := time.Duration(float64(time.Second) / bucket.Rate())
+		return overloaded(retryAfter, "Rate limit exceeded")
+	}
+	return sleep(ctx, t)
+}
+
+// waitBudget returns the longest wait leaving minProcessing before the deadline
+// of ctx, negative if there is not even minProcessing left, and false if ctx
+// has no deadline.
+func waitBudget(ctx context.Context, minProcessing time.Duration) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return deadline.Sub(time.Now()) - minProcessing, true
+}
+
+// waitBucket takes a token from bucket, waiting for it unless ctx is done first.
+func waitBucket(ctx context.Context, bucket *ratelimit.Bucket) error {
+	return sleep(ctx, bucket.Take(1))
+}
+
+func sleep(ctx context.Context, t time.Duration) error {
 	if t <= 0 {
-		resp, err = handler(ctx, req)
-		return resp, err
+		return nil
 	}
 
+	timer := time.NewTimer(t)
+	defer timer.Stop()
 	select {
-	case <-time.After(t):
-		resp, err = handler(ctx, req)
-		return resp, err
+	case <-timer.C:
+		return nil
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,152 @@
+package interceptor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	redisIdleConns = 8 // connections kept open between the calls
+)
+
+// redisBackend is a QuotaBackend speaking the redis protocol, over a pool of
+// connections, any connection failing is closed.
+type redisBackend struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// NewRedisBackend returns a QuotaBackend storing the counters on the redis
+// server at addr, timeout bounds every round trip.
+func NewRedisBackend(addr string, timeout time.Duration) QuotaBackend {
+	return &redisBackend{addr: addr, timeout: timeout, idle: make(chan *redisConn, redisIdleConns)}
+}
+
+func (r *redisBackend) Take(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	conn, err := r.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := r.incrExpire(ctx, conn, key, n, ttl)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	r.put(conn)
+	return count, nil
+}
+
+// get returns an idle connection, or a new one.
+func (r *redisBackend) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+
+	d := net.Dialer{Timeout: r.timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		d.Deadline = deadline
+	}
+	conn, err := d.Dial("tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// put keeps conn for the next calls, unless enough are idle already.
+func (r *redisBackend) put(conn *redisConn) {
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// incrExpire pipelines INCRBY and PEXPIRE, within timeout and the deadline of ctx.
+func (r *redisBackend) incrExpire(ctx context.Context, conn *redisConn, key string, n int64, ttl time.Duration) (int64, error) {
+	var deadline time.Time
+	if r.timeout > 0 {
+		deadline = time.Now().Add(r.timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// a canceled ctx interrupts the round trip.
+	done, exited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	cmds := writeCommand(nil, "INCRBY", key, strconv.FormatInt(n, 10))
+	cmds = writeCommand(cmds, "PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if _, err := conn.Write(cmds); err != nil {
+		return 0, err
+	}
+
+	count, err := readInteger(conn.rd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := readInteger(conn.rd); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func writeCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+func readInteger(rd *bufio.Reader) (int64, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '-':
+		return 0, fmt.Errorf("redis: %s", line[1:])
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
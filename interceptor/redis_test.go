@@ -0,0 +1,242 @@
+package interceptor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeRedis serves INCRBY and PEXPIRE over the redis protocol.
+type fakeRedis struct {
+	lis net.Listener
+
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]string
+	conns    int
+	fail     string // error replied to INCRBY if set
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{lis: lis, counters: make(map[string]int64), ttls: make(map[string]string)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, f.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case len(args) == 3 && args[0] == "INCRBY":
+		if f.fail != "" {
+			return "-" + f.fail + "\r\n"
+		}
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		f.counters[args[1]] += n
+		return fmt.Sprintf(":%d\r\n", f.counters[args[1]])
+	case len(args) == 3 && args[0] == "PEXPIRE":
+		f.ttls[args[1]] = args[2]
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func (f *fakeRedis) close() {
+	f.lis.Close()
+}
+
+// readCommand decodes a command encoded by writeCommand.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed array %q", line)
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") || !strings.HasSuffix(line, "\r\n") {
+			return nil, fmt.Errorf("malformed bulk string %q", line)
+		}
+		size, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestWriteCommand(t *testing.T) {
+	got := string(writeCommand(nil, "INCRBY", "quota:1", "10"))
+	want := "*3\r\n$6\r\nINCRBY\r\n$7\r\nquota:1\r\n$2\r\n10\r\n"
+	if got != want {
+		t.Errorf("writeCommand = %q, want %q", got, want)
+	}
+}
+
+func TestReadInteger(t *testing.T) {
+	tests := []struct {
+		reply string
+		n     int64
+		err   bool
+	}{
+		{":42\r\n", 42, false},
+		{":-1\r\n", -1, false},
+		{"-ERR wrong type\r\n", 0, true},
+		{"+OK\r\n", 0, true},
+		{":42\n", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		n, err := readInteger(bufio.NewReader(strings.NewReader(tt.reply)))
+		if (err != nil) != tt.err || n != tt.n {
+			t.Errorf("readInteger(%q) = %d, %v, want %d, error %v", tt.reply, n, err, tt.n, tt.err)
+		}
+	}
+}
+
+func TestRedisBackendTake(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.close()
+	backend := NewRedisBackend(f.lis.Addr().String(), time.Second)
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := backend.Take(context.Background(), "quota:1", 2, 1500*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Take: %v", err)
+		}
+		if n != 2*i {
+			t.Errorf("Take = %d, want %d", n, 2*i)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ttl := f.ttls["quota:1"]; ttl != "1500" {
+		t.Errorf("PEXPIRE %s, want 1500", ttl)
+	}
+	if f.conns != 1 {
+		t.Errorf("%d connections opened, want the idle one reused", f.conns)
+	}
+}
+
+func TestRedisBackendErrorReply(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.close()
+	backend := NewRedisBackend(f.lis.Addr().String(), time.Second)
+
+	f.mu.Lock()
+	f.fail = "ERR wrong type"
+	f.mu.Unlock()
+	if _, err := backend.Take(context.Background(), "quota:1", 1, time.Second); err == nil || !strings.Contains(err.Error(), "wrong type") {
+		t.Fatalf("Take = %v, want the error reply", err)
+	}
+
+	f.mu.Lock()
+	f.fail = ""
+	f.mu.Unlock()
+	n, err := backend.Take(context.Background(), "quota:1", 1, time.Second)
+	if err != nil || n != 1 {
+		t.Fatalf("Take = %d, %v, want 1 on a new connection", n, err)
+	}
+}
+
+func TestRedisBackendCanceled(t *testing.T) {
+	// a server which accepts but never replies.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	backend := NewRedisBackend(lis.Addr().String(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := backend.Take(ctx, "quota:1", 1, time.Second); err == nil {
+		t.Fatal("Take succeeded without reply")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Take returned after %v, want the deadline of ctx", elapsed)
+	}
+}
+
+func TestDistributedQuotaBackoff(t *testing.T) {
+	f := newFakeRedis(t)
+	addr := f.lis.Addr().String()
+	f.close()
+
+	q := newDistributedQuota(NewRedisBackend(addr, 100*time.Millisecond), "quota", time.Second, 10, 0)
+	if _, _, err := q.take(context.Background()); err == nil {
+		t.Fatal("take succeeded with the backend down")
+	}
+	if _, _, err := q.take(context.Background()); err != errQuotaUnreachable {
+		t.Errorf("take = %v, want %v while backing off", err, errQuotaUnreachable)
+	}
+}
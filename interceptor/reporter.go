@@ -0,0 +1,192 @@
+package interceptor
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/eddyzhou/log"
+	"github.com/getsentry/raven-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ErrorReport is an error observed by the Monitor.
+type ErrorReport struct {
+	Method   string
+	Peer     string
+	Metadata metadata.MD // incoming, with the credentials redacted
+	Err      error
+	Stack    string // set only when the error comes from a panic
+}
+
+func newErrorReport(ctx context.Context, method string, err error, stack string) *ErrorReport {
+	r := &ErrorReport{Method: method, Err: err, Stack: stack}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.Peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		r.Metadata = redactMetadata(md)
+	}
+	return r
+}
+
+// credentialKeys are the metadata keys whose values are never reported, as
+// are the keys containing one of credentialWords.
+var (
+	credentialKeys  = []string{"authorization", "proxy-authorization", "cookie", "set-cookie"}
+	credentialWords = []string{"token", "secret", "password", "passwd", "session", "api-key", "apikey", "signature"}
+)
+
+// redactMetadata returns a copy of md without the values of the credentials.
+func redactMetadata(md metadata.MD) metadata.MD {
+	redacted := make(metadata.MD, len(md))
+	for k, v := range md {
+		if isCredentialKey(k) {
+			v = []string{"[redacted]"}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+func isCredentialKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range credentialKeys {
+		if key == k {
+			return true
+		}
+	}
+	for _, w := range credentialWords {
+		if strings.Contains(key, w) {
+			return true
+		}
+	}
+	return false
+}
+
+type ErrorReporter interface {
+	Report(r *ErrorReport)
+}
+
+// Flusher is implemented by the reporters which send reports asynchronously.
+type Flusher interface {
+	// Flush blocks until the pending reports are sent.
+	Flush()
+}
+
+// ------------- sentry
+
+type sentryReporter struct {
+	client *raven.Client
+}
+
+func NewSentryReporter(sentryDSN string) (ErrorReporter, error) {
+	client, err := raven.New(sentryDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &sentryReporter{client: client}, nil
+}
+
+func (s *sentryReporter) Report(r *ErrorReport) {
+	packet := raven.NewPacket(r.Err.Error(), raven.NewException(r.Err, raven.NewStacktrace(2, 3, nil)))
+	packet.Extra["method"] = r.Method
+	packet.Extra["peer"] = r.Peer
+	if len(r.Metadata) > 0 {
+		packet.Extra["metadata"] = r.Metadata
+	}
+	if r.Stack != "" {
+		packet.Extra["stack"] = r.Stack
+	}
+	tags := map[string]string{"method": r.Method, "code": grpc.Code(r.Err).String()}
+	s.client.Capture(packet, tags)
+}
+
+func (s *sentryReporter) Flush() {
+	s.client.Wait()
+}
+
+// ------------- nop & log
+
+type nopReporter struct{}
+
+func NewNopReporter() ErrorReporter {
+	return nopReporter{}
+}
+
+func (nopReporter) Report(r *ErrorReport) {}
+
+type logReporter struct{}
+
+func NewLogReporter() ErrorReporter {
+	return logReporter{}
+}
+
+func (logReporter) Report(r *ErrorReport) {
+	if r.Stack != "" {
+		log.Errorf("report error: %s, peer=%s, err=%v, stack:\n%s", r.Method, r.Peer, r.Err, r.Stack)
+		return
+	}
+	log.Errorf("report error: %s, peer=%s, err=%v", r.Method, r.Peer, r.Err)
+}
+
+// ------------- filter
+
+// ReportFilter decides which errors reach the wrapped reporter.
+type ReportFilter struct {
+	// Codes reported, empty means all. Panics are always reported.
+	Codes []codes.Code
+	// SampleRate of reported errors in (0, 1], 0 means 1. Panics are not sampled.
+	SampleRate float64
+	// SuppressMethods are full method names never reported.
+	SuppressMethods []string
+}
+
+type filteredReporter struct {
+	reporter   ErrorReporter
+	codes      map[codes.Code]bool
+	sampleRate float64
+	suppressed map[string]bool
+}
+
+func NewFilteredReporter(reporter ErrorReporter, filter ReportFilter) ErrorReporter {
+	f := &filteredReporter{
+		reporter:   reporter,
+		sampleRate: filter.SampleRate,
+		suppressed: make(map[string]bool, len(filter.SuppressMethods)),
+	}
+	if len(filter.Codes) > 0 {
+		f.codes = make(map[codes.Code]bool, len(filter.Codes))
+		for _, c := range filter.Codes {
+			f.codes[c] = true
+		}
+	}
+	for _, m := range filter.SuppressMethods {
+		f.suppressed[m] = true
+	}
+	return f
+}
+
+func (f *filteredReporter) Report(r *ErrorReport) {
+	if f.suppressed[r.Method] {
+		return
+	}
+	if r.Stack == "" {
+		if f.codes != nil && !f.codes[grpc.Code(r.Err)] {
+			return
+		}
+		if f.sampleRate > 0 && f.sampleRate < 1 && rand.Float64() >= f.sampleRate {
+			return
+		}
+	}
+	f.reporter.Report(r)
+}
+
+func (f *filteredReporter) Flush() {
+	if fl, ok := f.reporter.(Flusher); ok {
+		fl.Flush()
+	}
+}
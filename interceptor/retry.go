@@ -1,20 +1,23 @@
 package interceptor
 
 import (
-	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"sync"
 	"time"
 
-	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/utils"
-
 	"github.com/eddyzhou/log"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
 )
 
 const (
-	AttemptMetadataKey = "x-retry-attempty"
+	AttemptMetadataKey = meta.RetryAttempt
 )
 
 var (
@@ -34,9 +37,13 @@ type BackoffFunc func(attempt uint) time.Duration
 type retryOptions struct {
 	max            uint
 	perCallTimeout time.Duration
+	splitDeadline  bool
+	minAttempt     time.Duration
 	includeHeader  bool
 	codes          []codes.Code
 	backoffFunc    BackoffFunc
+	budget         *RetryBudget
+	idempotency    *IdempotencyRegistry
 }
 
 type CallOption struct {
@@ -72,6 +79,40 @@ func WithPerRetryTimeout(timeout time.Duration) CallOption {
 	}}
 }
 
+// WithSplitDeadline bounds every attempt by an equal share of the time left
+// before the parent deadline between the remaining attempts, and by the
+// WithPerRetryTimeout if shorter.
+func WithSplitDeadline() CallOption {
+	return CallOption{applyFunc: func(o *retryOptions) {
+		o.splitDeadline = true
+	}}
+}
+
+// WithMinAttemptTime gives up retrying when less than d would be left before
+// the parent deadline once the backoff is over.
+func WithMinAttemptTime(d time.Duration) CallOption {
+	return CallOption{applyFunc: func(o *retryOptions) {
+		o.minAttempt = d
+	}}
+}
+
+// WithRetryBudget makes the retries take from budget, they are suppressed once
+// it is exhausted.
+func WithRetryBudget(budget *RetryBudget) CallOption {
+	return CallOption{applyFunc: func(o *retryOptions) {
+		o.budget = budget
+	}}
+}
+
+// WithIdempotency retries only the methods idempotent for registry, the others
+// only when the server rejected them before processing, with a pushback trailer.
+// Without registry, every method is retried.
+func WithIdempotency(registry *IdempotencyRegistry) CallOption {
+	return CallOption{applyFunc: func(o *retryOptions) {
+		o.idempotency = registry
+	}}
+}
+
 func BackoffUniformRandom(backoff time.Duration, jitter float64) BackoffFunc {
 	return func(attempt uint) time.Duration {
 		multiplier := jitter * (rand.Float64() - 0.5) * 2
@@ -79,6 +120,28 @@ func BackoffUniformRandom(backoff time.Duration, jitter float64) BackoffFunc {
 	}
 }
 
+// BackoffExponential waits a random duration up to base * 2^(attempt-1),
+// bounded by max (full jitter).
+func BackoffExponential(base time.Duration, max time.Duration) BackoffFunc {
+	return func(attempt uint) time.Duration {
+		ceil := math.Min(float64(max), float64(base)*math.Pow(2, float64(attempt)-1))
+		return time.Duration(rand.Float64() * ceil)
+	}
+}
+
+// BackoffDecorrelatedJitter waits a random duration between base and 3 times
+// the previous wait, bounded by max. The previous waits are drawn again on
+// every attempt, which gives the same distribution without per-call state.
+func BackoffDecorrelatedJitter(base time.Duration, max time.Duration) BackoffFunc {
+	return func(attempt uint) time.Duration {
+		wait := float64(base)
+		for i := uint(0); i < attempt; i++ {
+			wait = math.Min(float64(max), float64(base)+rand.Float64()*(3*wait-float64(base)))
+		}
+		return time.Duration(wait)
+	}
+}
+
 func mergeCallOptions(opt *retryOptions, callOptions ...CallOption) *retryOptions {
 	if len(callOptions) == 0 {
 		return opt
@@ -112,32 +175,50 @@ func UnaryClientRetry(optFuncs ...CallOption) grpc.UnaryClientInterceptor {
 		if callOpts.max == 0 {
 			return invoker(parentCtx, method, req, reply, cc, grpcOpts...)
 		}
+		parentCtx = withIdempotencyKey(parentCtx)
 
-		var lastErr error
+		var (
+			lastErr error
+			trailer metadata.MD
+		)
 		for attempt := uint(0); attempt < callOpts.max; attempt++ {
-			if err := waitRetryBackoff(attempt, parentCtx, callOpts); err != nil {
+			if !callOpts.budget.take(method, attempt) {
+				log.Warnf("gRPC retry attempt: %d, suppressed by the retry budget", attempt)
+				return lastErr
+			}
+			if err := waitRetryBackoff(attempt, parentCtx, callOpts, lastErr, trailer); err != nil {
 				return err
 			}
 
-			callCtx := perCallContext(parentCtx, callOpts, attempt)
-			lastErr = invoker(callCtx, method, req, reply, cc, grpcOpts...)
+			callCtx, cancel := perCallContext(parentCtx, callOpts, attempt)
+			trailer = nil
+			attemptOpts := append(append([]grpc.CallOption(nil), grpcOpts...), grpc.Trailer(&trailer))
+			lastErr = invoker(callCtx, method, req, reply, cc, attemptOpts...)
+			cancel()
 			if lastErr == nil {
 				return nil
 			}
 
 			log.Warnf("gRPC retry attempt: %d, err: %v", attempt, lastErr)
+			if delay, ok := Pushback(trailer); ok && delay < 0 {
+				log.Warnf("gRPC retry attempt: %d, server asked not to retry", attempt)
+				return lastErr
+			}
 			if isContextError(lastErr) {
 				if parentCtx.Err() != nil {
 					log.Warnf("gRPC retry attempt: %d, parent context error: %v", attempt, parentCtx.Err())
 					// its the parent context deadline or cancellation.
 					return lastErr
+				} else if !safeToRetry(callOpts, method, req, trailer) {
+					// the call may have been processed before it timed out.
+					return lastErr
 				} else {
 					log.Warnf("gRPC retry attempt: %d, context error from retry call", attempt)
 					// its the callCtx deadline or cancellation, in which case try again.
 					continue
 				}
 			}
-			if !isRetriable(lastErr, callOpts) {
+			if !isRetriable(lastErr, callOpts) || !safeToRetry(callOpts, method, req, trailer) {
 				return lastErr
 			}
 		}
@@ -145,6 +226,188 @@ func UnaryClientRetry(optFuncs ...CallOption) grpc.UnaryClientInterceptor {
 	}
 }
 
+// StreamClientRetry retries server-streaming calls that fail before the first
+// message is received. Client-streaming and bidi calls are never retried, and
+// WithPerRetryTimeout and WithSplitDeadline are ignored since they would bound
+// the whole stream.
+func StreamClientRetry(optFuncs ...CallOption) grpc.StreamClientInterceptor {
+	initOpts := mergeCallOptions(defaultOptions, optFuncs...)
+	return func(parentCtx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		grpcOpts, retryOpts := splitCallOptions(opts)
+		callOpts := mergeCallOptions(initOpts, retryOpts...)
+		if callOpts.max == 0 || desc.ClientStreams {
+			return streamer(parentCtx, desc, cc, method, grpcOpts...)
+		}
+		parentCtx = withIdempotencyKey(parentCtx)
+
+		streamOpts := *callOpts
+		streamOpts.perCallTimeout = 0
+		streamOpts.splitDeadline = false
+		rs := &retryingClientStream{
+			parentCtx: parentCtx,
+			desc:      desc,
+			cc:        cc,
+			method:    method,
+			streamer:  streamer,
+			grpcOpts:  grpcOpts,
+			callOpts:  &streamOpts,
+		}
+		if err := rs.newStream(nil, nil); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+}
+
+// retryingClientStream re-establishes a server-streaming call, replaying the
+// request, as long as no message has been received from the server.
+type retryingClientStream struct {
+	parentCtx context.Context
+	desc      *grpc.StreamDesc
+	cc        *grpc.ClientConn
+	method    string
+	streamer  grpc.Streamer
+	grpcOpts  []grpc.CallOption
+	callOpts  *retryOptions
+
+	mu         sync.Mutex
+	stream     grpc.ClientStream
+	cancel     context.CancelFunc // of the context of stream
+	attempt    uint
+	sent       []interface{}
+	sendClosed bool
+	received   bool
+}
+
+// newStream opens a stream starting at the current attempt, retrying while
+// lastErr and subsequent stream creation errors are retriable. trailer is the
+// one of the stream which failed with lastErr, if any.
+func (s *retryingClientStream) newStream(lastErr error, trailer metadata.MD) error {
+	for ; s.attempt < s.callOpts.max; s.attempt, trailer = s.attempt+1, nil {
+		if lastErr != nil && (!isRetriable(lastErr, s.callOpts) || !s.safeToRetry(trailer)) {
+			return lastErr
+		}
+		if delay, ok := Pushback(trailer); ok && delay < 0 {
+			log.Warnf("gRPC stream retry attempt: %d, server asked not to retry", s.attempt)
+			return lastErr
+		}
+		if !s.callOpts.budget.take(s.method, s.attempt) {
+			log.Warnf("gRPC stream retry attempt: %d, suppressed by the retry budget", s.attempt)
+			return lastErr
+		}
+		if err := waitRetryBackoff(s.attempt, s.parentCtx, s.callOpts, lastErr, trailer); err != nil {
+			return err
+		}
+
+		callCtx, cancel := perCallContext(s.parentCtx, s.callOpts, s.attempt)
+		lastErr = s.replay(callCtx, cancel)
+		if lastErr == nil {
+			return nil
+		}
+		cancel()
+		log.Warnf("gRPC stream retry attempt: %d, err: %v", s.attempt, lastErr)
+	}
+	return lastErr
+}
+
+func (s *retryingClientStream) safeToRetry(trailer metadata.MD) bool {
+	s.mu.Lock()
+	var req interface{}
+	if len(s.sent) > 0 {
+		req = s.sent[0]
+	}
+	s.mu.Unlock()
+	return safeToRetry(s.callOpts, s.method, req, trailer)
+}
+
+// replay opens a stream on ctx and sends it the messages sent so far, it
+// becomes the current stream, canceled by cancel, if it succeeds.
+func (s *retryingClientStream) replay(ctx context.Context, cancel context.CancelFunc) error {
+	stream, err := s.streamer(ctx, s.desc, s.cc, s.method, s.grpcOpts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	sent, sendClosed := s.sent, s.sendClosed
+	s.mu.Unlock()
+	for _, m := range sent {
+		if err := stream.SendMsg(m); err != nil {
+			return err
+		}
+	}
+	if sendClosed {
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.stream, s.cancel = stream, cancel
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *retryingClientStream) current() grpc.ClientStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream
+}
+
+func (s *retryingClientStream) Context() context.Context {
+	return s.current().Context()
+}
+
+func (s *retryingClientStream) Header() (metadata.MD, error) {
+	return s.current().Header()
+}
+
+func (s *retryingClientStream) Trailer() metadata.MD {
+	return s.current().Trailer()
+}
+
+func (s *retryingClientStream) SendMsg(m interface{}) error {
+	s.mu.Lock()
+	s.sent = append(s.sent, m)
+	stream := s.stream
+	s.mu.Unlock()
+	return stream.SendMsg(m)
+}
+
+func (s *retryingClientStream) CloseSend() error {
+	s.mu.Lock()
+	s.sendClosed = true
+	stream := s.stream
+	s.mu.Unlock()
+	return stream.CloseSend()
+}
+
+// RecvMsg must not be called concurrently with itself, as required by grpc.
+func (s *retryingClientStream) RecvMsg(m interface{}) error {
+	err := s.current().RecvMsg(m)
+	for err != nil && err != io.EOF && !s.received && s.parentCtx.Err() == nil {
+		log.Warnf("gRPC stream retry attempt: %d, err: %v", s.attempt, err)
+		trailer := s.current().Trailer()
+		s.attempt++
+		if err = s.newStream(err, trailer); err != nil {
+			break
+		}
+		err = s.current().RecvMsg(m)
+	}
+	if err == nil {
+		s.received = true
+	} else {
+		// the stream is over, release its context.
+		s.mu.Lock()
+		s.cancel()
+		s.mu.Unlock()
+	}
+	return err
+}
+
 func isRetriable(err error, callOpts *retryOptions) bool {
 	errCode := grpc.Code(err)
 	if isContextError(err) {
@@ -158,35 +421,78 @@ func isRetriable(err error, callOpts *retryOptions) bool {
 	return false
 }
 
-func waitRetryBackoff(attempt uint, parentCtx context.Context, callOpts *retryOptions) error {
-	var waitTime time.Duration = 0
-	if attempt > 0 {
-		waitTime = callOpts.backoffFunc(attempt)
+// safeToRetry reports whether the call may be sent again: always for the
+// idempotent methods, else only if the server rejected it before processing.
+func safeToRetry(callOpts *retryOptions, method string, req interface{}, trailer metadata.MD) bool {
+	if callOpts.idempotency == nil || callOpts.idempotency.IsIdempotent(method, req) {
+		return true
 	}
-	if waitTime > 0 {
-		log.Infof("gRPC retry attempt: %d, backoff for %v", attempt, waitTime)
-		select {
-		case <-parentCtx.Done():
-			return convToGrpcErr(parentCtx.Err())
-		case <-time.Tick(waitTime):
-		}
+	_, ok := Pushback(trailer)
+	return ok
+}
+
+// waitRetryBackoff waits for the backoff, or for the retry delay the server
+// asked for through the pushback trailer or lastErr if longer, so that the
+// retries keep their jitter. lastErr is returned when
+// the attempt could not start with minAttempt left before the parent deadline.
+func waitRetryBackoff(attempt uint, parentCtx context.Context, callOpts *retryOptions, lastErr error, trailer metadata.MD) error {
+	if attempt == 0 {
+		return nil
 	}
-	return nil
+	waitTime := callOpts.backoffFunc(attempt)
+	if retryAfter, ok := serverRetryDelay(lastErr, trailer); ok && retryAfter > waitTime {
+		waitTime = retryAfter
+	}
+	if deadline, ok := parentCtx.Deadline(); ok && deadline.Sub(time.Now()) < waitTime+callOpts.minAttempt {
+		log.Warnf("gRPC retry attempt: %d, not started, parent deadline in %v", attempt, deadline.Sub(time.Now()))
+		return lastErr
+	}
+	if waitTime <= 0 {
+		return nil
+	}
+
+	log.Infof("gRPC retry attempt: %d, backoff for %v", attempt, waitTime)
+	timer := time.NewTimer(waitTime)
+	defer timer.Stop()
+	select {
+	case <-parentCtx.Done():
+		return convToGrpcErr(parentCtx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// serverRetryDelay returns the delay of the pushback trailer, else of the
+// errdetails.RetryInfo of lastErr.
+func serverRetryDelay(lastErr error, trailer metadata.MD) (time.Duration, bool) {
+	if delay, ok := Pushback(trailer); ok && delay >= 0 {
+		return delay, true
+	}
+	return RetryAfter(lastErr)
 }
 
 func isContextError(err error) bool {
 	return grpc.Code(err) == codes.DeadlineExceeded || grpc.Code(err) == codes.Canceled
 }
 
-func perCallContext(parentCtx context.Context, callOpts *retryOptions, attempt uint) context.Context {
-	ctx := parentCtx
-	if callOpts.perCallTimeout != 0 {
-		ctx, _ = context.WithTimeout(ctx, callOpts.perCallTimeout)
+// perCallContext returns the context of attempt, bounded by the per-attempt
+// timeout, and the func releasing it, which must be called once the attempt is over.
+func perCallContext(parentCtx context.Context, callOpts *retryOptions, attempt uint) (context.Context, context.CancelFunc) {
+	timeout := callOpts.perCallTimeout
+	if deadline, ok := parentCtx.Deadline(); ok && callOpts.splitDeadline {
+		split := deadline.Sub(time.Now()) / time.Duration(callOpts.max-attempt)
+		if timeout == 0 || split < timeout {
+			timeout = split
+		}
+	}
+	ctx, cancel := parentCtx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 	}
 	if attempt > 0 && callOpts.includeHeader {
-		ctx = utils.Set(ctx, AttemptMetadataKey, fmt.Sprintf("%d", attempt))
+		ctx = meta.SetOutgoingInt(ctx, AttemptMetadataKey, int64(attempt))
 	}
-	return ctx
+	return ctx, cancel
 }
 
 func convToGrpcErr(err error) error {
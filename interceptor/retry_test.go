@@ -0,0 +1,50 @@
+package interceptor
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRetryHonorsPushbackOnDeadline(t *testing.T) {
+	th := NewThrottler(10, 10, time.Second)
+	th.SetMinProcessing(time.Hour)
+	var attempts int32
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&attempts, 1)
+		return th.Throttle(ctx, req, info, handler)
+	}
+	check := func(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+		return &healthpb.HealthCheckResponse{}, nil
+	}
+	retry := UnaryClientRetry(WithRetryMax(3), WithRetryBackoff(func(uint) time.Duration { return time.Millisecond }))
+	client, stop := startHealth(t, check, unary, retry)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Check = %v, want DeadlineExceeded", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("%d attempts, want the pushback honored", n)
+	}
+}
+
+func TestRetryBackoffLongerThanServerDelay(t *testing.T) {
+	callOpts := mergeCallOptions(defaultOptions, WithRetryBackoff(func(uint) time.Duration { return 30 * time.Millisecond }))
+	lastErr := ErrorWithRetryAfter(codes.ResourceExhausted, 300*time.Microsecond, "overloaded")
+
+	start := time.Now()
+	if err := waitRetryBackoff(1, context.Background(), callOpts, lastErr, nil); err != nil {
+		t.Fatalf("waitRetryBackoff: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("waited %v, want the backoff when longer than the server delay", elapsed)
+	}
+}
@@ -0,0 +1,105 @@
+package interceptor
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
+)
+
+const (
+	// PushbackMetadataKey is the trailer telling the client how many
+	// milliseconds to wait before retrying, or not to retry if negative.
+	PushbackMetadataKey = meta.RetryPushback
+
+	minRetryAfter = 10 * time.Millisecond // the shortest delay told by the throttler and the rate limiter
+)
+
+// ErrorWithRetryAfter returns a grpc error carrying an errdetails.RetryInfo,
+// telling the client to wait delay before retrying.
+func ErrorWithRetryAfter(c codes.Code, delay time.Duration, msg string) error {
+	s := &spb.Status{Code: int32(c), Message: msg}
+	if detail, err := ptypes.MarshalAny(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(delay)}); err == nil {
+		s.Details = append(s.Details, detail)
+	}
+	return status.ErrorProto(s)
+}
+
+// RetryAfter returns the delay of the errdetails.RetryInfo carried by err.
+func RetryAfter(err error) (time.Duration, bool) {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return 0, false
+	}
+	for _, detail := range s.Proto().Details {
+		var info errdetails.RetryInfo
+		if !ptypes.Is(detail, &info) {
+			continue
+		}
+		if err := ptypes.UnmarshalAny(detail, &info); err != nil || info.RetryDelay == nil {
+			continue
+		}
+		if delay, err := ptypes.Duration(info.RetryDelay); err == nil {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// Pushback returns the delay of the pushback trailer, negative if the server
+// asked not to retry.
+func Pushback(trailer metadata.MD) (time.Duration, bool) {
+	if len(trailer[PushbackMetadataKey]) == 0 {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(trailer[PushbackMetadataKey][0], 10, 64)
+	if err != nil || ms < 0 {
+		return -1, true
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// pushbackTrailer returns the trailer telling the client when to retry after
+// err, never for a deadline too short to be served.
+func pushbackTrailer(err error) (metadata.MD, bool) {
+	if err == errDeadlineTooShort {
+		return metadata.Pairs(PushbackMetadataKey, "-1"), true
+	}
+	if delay, ok := RetryAfter(err); ok {
+		// rounded up, so that a short delay is not told as none.
+		ms := int64((delay + time.Millisecond - 1) / time.Millisecond)
+		return metadata.Pairs(PushbackMetadataKey, strconv.FormatInt(ms, 10)), true
+	}
+	return nil, false
+}
+
+// overloaded returns a ResourceExhausted error telling the client to retry
+// after delay, at least minRetryAfter, e.g. while the average latency is not
+// known yet.
+func overloaded(delay time.Duration, msg string) error {
+	if delay < minRetryAfter {
+		delay = minRetryAfter
+	}
+	return ErrorWithRetryAfter(codes.ResourceExhausted, delay, msg)
+}
+
+func setPushback(ctx context.Context, err error) {
+	if md, ok := pushbackTrailer(err); ok {
+		grpc.SetTrailer(ctx, md)
+	}
+}
+
+func setStreamPushback(ss grpc.ServerStream, err error) {
+	if md, ok := pushbackTrailer(err); ok {
+		ss.SetTrailer(md)
+	}
+}
@@ -1,19 +1,50 @@
 package interceptor
 
 import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eddyzhou/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 )
 
-type token struct{}
+// waiter is a call queued for a slot of the backlog or of the concurrency limit.
+type waiter struct {
+	ready    chan struct{}
+	granted  bool
+	err      error // set when the waiter is shed instead of granted
+	priority Priority
+	enqueued time.Time
+}
 
+// Throttler bounds the calls running concurrently by limit, the others wait in
+// a backlog of backlogLimit calls for at most backlogTimeout. The calls which
+// do not fit in the backlog wait for room in it, as long as their context allows.
 type Throttler struct {
-	tokens         chan token
-	backlogTokens  chan token
+	mu             sync.Mutex
+	limit          int
+	backlogLimit   int
 	backlogTimeout time.Duration
+	inFlight       int // calls running
+	admitted       int // calls running or in the backlog
+	tokenQueue     []*waiter
+	backlogQueue   []*waiter
+
+	adaptive *adaptiveLimit
+
+	classify      PriorityFunc
+	reserved      map[Priority]int
+	codelTarget   time.Duration
+	codelInterval time.Duration
+
+	minProcessing    time.Duration
+	avgLatency       time.Duration // moving average of the calls latency
+	deadlineRejected uint64
 }
 
 func NewThrottler(limit int, backlogLimit int, backlogTimeout time.Duration) *Throttler {
@@ -25,47 +56,510 @@ func NewThrottler(limit int, backlogLimit int, backlogTimeout time.Duration) *Th
 		panic("xmiddleware/throttler: Throttle expects backlogLimit to be positive")
 	}
 
-	t := Throttler{
-		tokens:         make(chan token, limit),
-		backlogTokens:  make(chan token, limit+backlogLimit),
+	return &Throttler{
+		limit:          limit,
+		backlogLimit:   backlogLimit,
 		backlogTimeout: backlogTimeout,
 	}
+}
 
-	// Filling tokens.
-	for i := 0; i < limit+backlogLimit; i++ {
-		if i < limit {
-			t.tokens <- token{}
-		}
-		t.backlogTokens <- token{}
+// SetLimits changes the limits while serving. A higher limit or backlog lets
+// the waiting calls in at once, a lower one lets the calls in flight finish.
+// With an adaptive limit, limit restarts the adaptation, within its bounds.
+func (t *Throttler) SetLimits(limit int, backlogLimit int, backlogTimeout time.Duration) error {
+	if limit < 1 {
+		return fmt.Errorf("xmiddleware/throttler: limit expects to be positive, got %d", limit)
+	}
+	if backlogLimit < 0 {
+		return fmt.Errorf("xmiddleware/throttler: backlogLimit expects to be positive, got %d", backlogLimit)
 	}
 
-	return &t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a := t.adaptive; a != nil {
+		a.limit = math.Max(float64(a.minLimit), math.Min(float64(a.maxLimit), float64(limit)))
+		limit = int(a.limit)
+	}
+	log.Infof("throttler limits: limit %d -> %d, backlogLimit %d -> %d, backlogTimeout %v -> %v",
+		t.limit, limit, t.backlogLimit, backlogLimit, t.backlogTimeout, backlogTimeout)
+	t.limit = limit
+	t.backlogLimit = backlogLimit
+	t.backlogTimeout = backlogTimeout
+	t.dispatch()
+	return nil
+}
+
+// Saturated reports whether both the concurrency limit and the backlog are full.
+func (t *Throttler) Saturated() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.admitted >= t.limit+t.backlogLimit
+}
+
+// Limit returns the current concurrency limit.
+func (t *Throttler) Limit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// BacklogTimeout returns the current time a call waits in the backlog at most.
+func (t *Throttler) BacklogTimeout() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backlogTimeout
+}
+
+// InFlight returns the number of calls running.
+func (t *Throttler) InFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight
 }
 
 func (t *Throttler) Throttle(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	select {
-	case btok := <-t.backlogTokens:
-		timer := time.NewTimer(t.backlogTimeout)
+	release, err := t.acquire(ctx, info.FullMethod)
+	if err != nil {
+		setPushback(ctx, err)
+		return nil, err
+	}
+	defer release()
 
-		defer func() {
-			t.backlogTokens <- btok
-		}()
+	return handler(ctx, req)
+}
 
-		select {
-		case <-timer.C:
-			return nil, grpc.Errorf(codes.ResourceExhausted, "Concurrent RPC limit exceeded")
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case tok := <-t.tokens:
-			defer func() {
-				t.tokens <- tok
-			}()
+func (t *Throttler) StreamThrottle(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	release, err := t.acquire(ss.Context(), info.FullMethod)
+	if err != nil {
+		setStreamPushback(ss, err)
+		return err
+	}
+	defer release()
 
-			resp, err = handler(ctx, req)
-			return resp, err
+	return handler(srv, ss)
+}
+
+// acquire waits for a slot, returning the func that gives it back.
+func (t *Throttler) acquire(ctx context.Context, fullMethod string) (func(), error) {
+	priority := PriorityNormal
+	if t.classify != nil {
+		priority = t.classify(ctx, fullMethod)
+	}
+	if budget, ok := waitBudget(ctx, t.minProcessing); ok && budget < 0 {
+		atomic.AddUint64(&t.deadlineRejected, 1)
+		return nil, errDeadlineTooShort
+	}
+	if err := t.admit(ctx, priority); err != nil {
+		return nil, err
+	}
+	if err := t.run(ctx, priority); err != nil {
+		t.mu.Lock()
+		t.admitted--
+		t.dispatch()
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		latency := time.Since(start)
+		t.avgLatency += (latency - t.avgLatency) / 8
+		if t.adaptive != nil {
+			t.adaptive.sample(t, latency)
 		}
+		t.inFlight--
+		t.admitted--
+		t.dispatch()
+	}, nil
+}
 
+// admit waits for room in the backlog, made by shedding a less important call
+// of the backlog if any.
+func (t *Throttler) admit(ctx context.Context, priority Priority) error {
+	t.mu.Lock()
+	if t.admitted < t.limit+t.backlogLimit && len(t.backlogQueue) == 0 || t.shedFor(priority) {
+		t.admitted++
+		t.mu.Unlock()
+		return nil
+	}
+	w := &waiter{ready: make(chan struct{}), priority: priority, enqueued: time.Now()}
+	t.backlogQueue = append(t.backlogQueue, w)
+	t.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		if t.cancel(w, &t.backlogQueue) {
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// run waits for a slot of the concurrency limit, for at most backlogTimeout,
+// or less if the deadline of ctx would not leave minProcessing to the call.
+func (t *Throttler) run(ctx context.Context, priority Priority) error {
+	t.mu.Lock()
+	if t.inFlight < t.allowed(priority) && t.waitingAhead(priority) == 0 {
+		t.inFlight++
+		t.mu.Unlock()
+		return nil
+	}
+	timeout, deadlineBound := t.backlogTimeout, false
+	if budget, ok := waitBudget(ctx, t.minProcessing); ok {
+		if budget < t.expectedWait(priority) {
+			t.mu.Unlock()
+			atomic.AddUint64(&t.deadlineRejected, 1)
+			return errDeadlineTooShort
+		}
+		if budget < timeout {
+			timeout, deadlineBound = budget, true
+		}
+	}
+	w := &waiter{ready: make(chan struct{}), priority: priority, enqueued: time.Now()}
+	t.tokenQueue = append(t.tokenQueue, w)
+	// a slot may be free for w, e.g. reserved for its priority.
+	t.dispatch()
+	t.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-timer.C:
+		if t.cancel(w, &t.tokenQueue) {
+			return nil
+		}
+		if deadlineBound {
+			atomic.AddUint64(&t.deadlineRejected, 1)
+			return errDeadlineTooShort
+		}
+		t.mu.Lock()
+		retryAfter := t.expectedWait(priority)
+		t.mu.Unlock()
+		return overloaded(retryAfter, "Concurrent RPC limit exceeded")
+	case <-ctx.Done():
+		if t.cancel(w, &t.tokenQueue) {
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// expectedWait estimates the wait for a slot of a call of priority, from the
+// calls waiting ahead of it and the average latency. t.mu must be held.
+func (t *Throttler) expectedWait(priority Priority) time.Duration {
+	limit := t.allowed(priority)
+	if limit < 1 {
+		limit = 1
+	}
+	return t.avgLatency * time.Duration(t.waitingAhead(priority)+1) / time.Duration(limit)
+}
+
+// waitingAhead returns the calls waiting which run before a call of priority,
+// the ones as important or more. t.mu must be held.
+func (t *Throttler) waitingAhead(priority Priority) int {
+	ahead := 0
+	for _, w := range t.tokenQueue {
+		if w.priority <= priority {
+			ahead++
+		}
+	}
+	return ahead
+}
+
+// cancel removes w from queue, it reports whether w was granted in the meantime.
+func (t *Throttler) cancel(w *waiter, queue *[]*waiter) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w.granted {
+		return w.err == nil
+	}
+	removeWaiter(queue, w)
+	return false
+}
+
+func removeWaiter(queue *[]*waiter, w *waiter) {
+	q := *queue
+	for i := range q {
+		if q[i] == w {
+			*queue = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch grants the free slots to the waiters, t.mu must be held.
+func (t *Throttler) dispatch() {
+	t.shedStale()
+	for {
+		w := t.nextWaiter()
+		if w == nil {
+			break
+		}
+		removeWaiter(&t.tokenQueue, w)
+		t.inFlight++
+		w.granted = true
+		close(w.ready)
+	}
+	for t.admitted < t.limit+t.backlogLimit && len(t.backlogQueue) > 0 {
+		w := t.backlogQueue[0]
+		for _, c := range t.backlogQueue[1:] {
+			if c.priority < w.priority {
+				w = c
+			}
+		}
+		removeWaiter(&t.backlogQueue, w)
+		t.admitted++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// ------------- priorities
+
+// SetPriorities classifies the calls by classify. reserved[p] slots of the
+// limit are kept for the calls of priority p or more important, the more
+// important calls waiting are run first and the least important calls waiting
+// are shed to make room in a full backlog. It must be called before serving.
+func (t *Throttler) SetPriorities(classify PriorityFunc, reserved map[Priority]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.classify = classify
+	t.reserved = reserved
+}
+
+// SetCoDel makes the backlog LIFO while its oldest call has waited more than
+// target, so that the fresh calls are served before the ones whose clients may
+// have given up, and sheds the calls which have waited more than interval.
+// It must be called before serving.
+func (t *Throttler) SetCoDel(target time.Duration, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.codelTarget = target
+	t.codelInterval = interval
+}
+
+// allowed returns the part of the limit the calls of priority may use, t.mu must be held.
+func (t *Throttler) allowed(priority Priority) int {
+	limit := t.limit
+	for p, n := range t.reserved {
+		if p < priority {
+			limit -= n
+		}
+	}
+	return limit
+}
+
+// nextWaiter returns the waiter to run, the most important one allowed to,
+// the newest of its priority if the backlog is standing. t.mu must be held.
+func (t *Throttler) nextWaiter() *waiter {
+	var next *waiter
+	for _, w := range t.tokenQueue {
+		if t.inFlight >= t.allowed(w.priority) {
+			continue
+		}
+		if next == nil || w.priority < next.priority {
+			next = w
+		}
+	}
+	if next == nil || t.codelTarget <= 0 {
+		return next
+	}
+
+	var oldest, newest *waiter
+	for _, w := range t.tokenQueue {
+		if w.priority != next.priority {
+			continue
+		}
+		if oldest == nil || w.enqueued.Before(oldest.enqueued) {
+			oldest = w
+		}
+		if newest == nil || w.enqueued.After(newest.enqueued) {
+			newest = w
+		}
+	}
+	if time.Since(oldest.enqueued) > t.codelTarget {
+		return newest
+	}
+	return oldest
+}
+
+// shedStale rejects the waiters older than the CoDel interval, t.mu must be held.
+func (t *Throttler) shedStale() {
+	if t.codelInterval <= 0 {
+		return
+	}
+	kept := t.tokenQueue[:0]
+	for _, w := range t.tokenQueue {
+		if time.Since(w.enqueued) > t.codelInterval {
+			t.shed(w, "Shed after waiting too long")
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	t.tokenQueue = kept
+}
+
+// shedFor sheds the least important waiter less important than priority, if
+// any, to make room for a call of priority. t.mu must be held.
+func (t *Throttler) shedFor(priority Priority) bool {
+	var victim *waiter
+	for _, w := range t.tokenQueue {
+		if w.priority <= priority {
+			continue
+		}
+		if victim == nil || w.priority > victim.priority ||
+			w.priority == victim.priority && w.enqueued.Before(victim.enqueued) {
+			victim = w
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	removeWaiter(&t.tokenQueue, victim)
+	t.shed(victim, "Shed for a more important call")
+	return true
+}
+
+func (t *Throttler) shed(w *waiter, msg string) {
+	w.granted = true
+	w.err = overloaded(t.avgLatency, msg)
+	close(w.ready)
+}
+
+// SetMinProcessing rejects with DeadlineExceeded, without waiting, the calls
+// whose deadline would leave less than minProcessing to be served after their
+// expected wait. It must be called before serving.
+func (t *Throttler) SetMinProcessing(minProcessing time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.minProcessing = minProcessing
+}
+
+// DeadlineRejected returns the number of calls rejected for a too short deadline.
+func (t *Throttler) DeadlineRejected() uint64 {
+	return atomic.LoadUint64(&t.deadlineRejected)
+}
+
+// ------------- adaptive limit
+
+// SetAdaptive makes the concurrency limit follow the latency of the calls,
+// within [minLimit, maxLimit]: every window, the limit is scaled by the ratio
+// of the lowest latency seen to the latency of the window, plus a queue of
+// sqrt(limit) calls, so that it shrinks when the calls slow down and grows back
+// when they do not. It must be called before serving.
+func (t *Throttler) SetAdaptive(minLimit int, maxLimit int, window time.Duration) {
+	if minLimit < 1 || maxLimit < minLimit {
+		panic("xmiddleware/throttler: SetAdaptive expects 0 < minLimit <= maxLimit")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit < minLimit {
+		t.limit = minLimit
+	}
+	if t.limit > maxLimit {
+		t.limit = maxLimit
+	}
+	t.adaptive = &adaptiveLimit{
+		minLimit:    minLimit,
+		maxLimit:    maxLimit,
+		window:      window,
+		limit:       float64(t.limit),
+		windowStart: time.Now(),
+	}
+}
+
+// RegisterMetrics exports the current limit and the calls in flight as gauges,
+// and the calls rejected for a too short deadline, labelled with server. They
+// are not exported if a throttler of the same server is registered already.
+func (t *Throttler) RegisterMetrics(application string, server string, registerer prometheus.Registerer) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	registerInstance(registerer, prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   application,
+			Name:        "throttler_limit",
+			Help:        "Current concurrency limit of the throttler",
+			ConstLabels: prometheus.Labels{"server": server},
+		},
+		func() float64 { return float64(t.Limit()) },
+	))
+	registerInstance(registerer, prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   application,
+			Name:        "throttler_in_flight",
+			Help:        "Calls running in the throttler",
+			ConstLabels: prometheus.Labels{"server": server},
+		},
+		func() float64 { return float64(t.InFlight()) },
+	))
+	registerInstance(registerer, prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace:   application,
+			Name:        "throttler_deadline_rejected_total",
+			Help:        "Calls rejected by the throttler for a deadline too short to be served",
+			ConstLabels: prometheus.Labels{"server": server},
+		},
+		func() float64 { return float64(t.DeadlineRejected()) },
+	))
+}
+
+const (
+	adaptiveSmoothing  = 0.2
+	adaptiveMinRTTLife = 60 // windows before the lowest latency is measured again
+)
+
+// adaptiveLimit is a gradient concurrency limit, guarded by Throttler.mu.
+type adaptiveLimit struct {
+	minLimit int
+	maxLimit int
+	window   time.Duration
+
+	limit       float64
+	minRTT      time.Duration
+	windows     int
+	windowStart time.Time
+	rttSum      time.Duration
+	samples     int
+	maxInFlight int
+}
+
+func (a *adaptiveLimit) sample(t *Throttler, rtt time.Duration) {
+	a.rttSum += rtt
+	a.samples++
+	if t.inFlight > a.maxInFlight {
+		a.maxInFlight = t.inFlight
+	}
+	if time.Since(a.windowStart) < a.window {
+		return
+	}
+
+	avg := a.rttSum / time.Duration(a.samples)
+	a.windows++
+	if a.minRTT == 0 || avg < a.minRTT || a.windows >= adaptiveMinRTTLife {
+		a.minRTT, a.windows = avg, 0
+	}
+
+	gradient := math.Max(0.5, math.Min(1, float64(a.minRTT)/float64(avg)))
+	newLimit := a.limit*gradient + math.Sqrt(a.limit)
+	// the calls did not use the limit, there is nothing to learn about a higher one.
+	if newLimit > a.limit && a.maxInFlight < int(a.limit)/2 {
+		newLimit = a.limit
+	}
+	a.limit = (1-adaptiveSmoothing)*a.limit + adaptiveSmoothing*newLimit
+	a.limit = math.Max(float64(a.minLimit), math.Min(float64(a.maxLimit), a.limit))
+
+	if limit := int(a.limit); limit != t.limit {
+		log.Debugf("throttler limit: %d -> %d, rtt=%v, minRTT=%v", t.limit, limit, avg, a.minRTT)
+		t.limit = limit
 	}
+	a.windowStart, a.rttSum, a.samples, a.maxInFlight = time.Now(), 0, 0, 0
 }
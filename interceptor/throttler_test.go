@@ -0,0 +1,137 @@
+package interceptor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+const (
+	normalMethod   = "/test.Service/Normal"
+	criticalMethod = "/test.Service/Critical"
+)
+
+func newReservedThrottler() *Throttler {
+	t := NewThrottler(10, 10, time.Second)
+	t.SetPriorities(
+		NewPriorityFunc(PriorityNormal, PriorityPattern{Pattern: criticalMethod, Priority: PriorityCritical}),
+		map[Priority]int{PriorityCritical: 2},
+	)
+	return t
+}
+
+type acquired struct {
+	release func()
+	err     error
+}
+
+func acquireAsync(t *Throttler, method string) chan acquired {
+	ch := make(chan acquired, 1)
+	go func() {
+		release, err := t.acquire(context.Background(), method)
+		ch <- acquired{release, err}
+	}()
+	return ch
+}
+
+func waitAcquired(tb testing.TB, ch chan acquired, timeout time.Duration) func() {
+	select {
+	case a := <-ch:
+		if a.err != nil {
+			tb.Fatalf("acquire: %v", a.err)
+		}
+		return a.release
+	case <-time.After(timeout):
+		tb.Fatalf("acquire still waiting after %v", timeout)
+		return nil
+	}
+}
+
+func TestThrottlerReservedSlots(t *testing.T) {
+	th := newReservedThrottler()
+
+	var releases []func()
+	for i := 0; i < 8; i++ {
+		releases = append(releases, waitAcquired(t, acquireAsync(th, normalMethod), 100*time.Millisecond))
+	}
+
+	// the reserved slots are not for the normal calls.
+	queued := acquireAsync(th, normalMethod)
+	select {
+	case <-queued:
+		t.Fatal("normal call ran in a reserved slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a critical call runs at once, ahead of the normal call waiting.
+	critical := waitAcquired(t, acquireAsync(th, criticalMethod), 100*time.Millisecond)
+	if n := th.InFlight(); n != 9 {
+		t.Errorf("%d calls in flight, want 9", n)
+	}
+
+	// the normal call waits for a normal slot.
+	critical()
+	select {
+	case <-queued:
+		t.Fatal("normal call ran in a reserved slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releases[0]()
+	releases = append(releases[1:], waitAcquired(t, queued, 100*time.Millisecond))
+
+	for _, release := range releases {
+		release()
+	}
+	if n := th.InFlight(); n != 0 {
+		t.Errorf("%d calls in flight, want 0", n)
+	}
+}
+
+func TestThrottlerCriticalUsesAllSlots(t *testing.T) {
+	th := newReservedThrottler()
+
+	var releases []func()
+	for i := 0; i < 10; i++ {
+		releases = append(releases, waitAcquired(t, acquireAsync(th, criticalMethod), 100*time.Millisecond))
+	}
+	if n := th.InFlight(); n != 10 {
+		t.Errorf("%d calls in flight, want 10", n)
+	}
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestThrottlerRegisterMetricsTwice(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	NewThrottler(10, 10, time.Second).RegisterMetrics("test", "", registry)
+	NewThrottler(10, 10, time.Second).RegisterMetrics("test", "", registry)
+	NewThrottler(20, 10, time.Second).RegisterMetrics("test", "other", registry)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "test_throttler_limit" && len(f.GetMetric()) != 2 {
+			t.Errorf("%d throttler_limit series, want one per server", len(f.GetMetric()))
+		}
+	}
+}
+
+func TestThrottlerRetryAfterFloor(t *testing.T) {
+	th := NewThrottler(1, 1, 10*time.Millisecond)
+	release := waitAcquired(t, acquireAsync(th, normalMethod), 100*time.Millisecond)
+	defer release()
+
+	// the average latency is not known yet.
+	_, err := th.acquire(context.Background(), normalMethod)
+	if delay, ok := RetryAfter(err); !ok || delay < minRetryAfter {
+		t.Errorf("acquire = %v, want a retry delay of at least %v", err, minRetryAfter)
+	}
+	if md, ok := pushbackTrailer(err); !ok || md[PushbackMetadataKey][0] == "0" {
+		t.Errorf("pushback trailer = %v, want a positive delay", md)
+	}
+}
@@ -0,0 +1,144 @@
+package xmiddleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eddyzhou/log"
+)
+
+// LimitsConfig is the content of the file watched by LimitsConfigFile, e.g.
+//
+//	{
+//	  "throttler": {"limit": 100, "backlog_limit": 50, "backlog_timeout": "1s"},
+//	  "rate_limit": {"fill_interval": "10ms", "capacity": 100, "quantum": 1}
+//	}
+//
+// A section omitted leaves its limiter unchanged.
+type LimitsConfig struct {
+	Throttler *ThrottlerLimits `json:"throttler"`
+	RateLimit *RateLimitLimits `json:"rate_limit"`
+}
+
+type ThrottlerLimits struct {
+	Limit          int    `json:"limit"`
+	BacklogLimit   int    `json:"backlog_limit"`
+	BacklogTimeout string `json:"backlog_timeout"` // unchanged if omitted
+}
+
+type RateLimitLimits struct {
+	FillInterval string `json:"fill_interval"`
+	Capacity     int64  `json:"capacity"`
+	Quantum      int64  `json:"quantum"` // 1 if omitted
+}
+
+// ApplyLimits updates the throttler and the rate limiter of the server while
+// serving, an error leaves the limiter concerned unchanged.
+func (s *XServer) ApplyLimits(conf *LimitsConfig) error {
+	if tl := conf.Throttler; tl != nil {
+		if s.Throttler == nil {
+			return fmt.Errorf("xmiddleware: no throttler configured")
+		}
+		timeout := s.Throttler.BacklogTimeout()
+		if tl.BacklogTimeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(tl.BacklogTimeout); err != nil {
+				return fmt.Errorf("xmiddleware: throttler backlog_timeout: %v", err)
+			}
+		}
+		if err := s.Throttler.SetLimits(tl.Limit, tl.BacklogLimit, timeout); err != nil {
+			return err
+		}
+	}
+	if rl := conf.RateLimit; rl != nil {
+		if s.RateLimiter == nil {
+			return fmt.Errorf("xmiddleware: no rate limiter configured")
+		}
+		fillInterval, err := time.ParseDuration(rl.FillInterval)
+		if err != nil {
+			return fmt.Errorf("xmiddleware: rate_limit fill_interval: %v", err)
+		}
+		quantum := rl.Quantum
+		if quantum == 0 {
+			quantum = 1
+		}
+		if err := s.RateLimiter.SetRate(fillInterval, rl.Capacity, quantum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitsWatcher applies the limits file to the server whenever it changes.
+type limitsWatcher struct {
+	server   *XServer
+	path     string
+	interval time.Duration
+	modTime  time.Time
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func newLimitsWatcher(server *XServer, path string, interval time.Duration) *limitsWatcher {
+	return &limitsWatcher{
+		server:   server,
+		path:     path,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+}
+
+func (w *limitsWatcher) run() {
+	w.check()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *limitsWatcher) stop() {
+	w.quitOnce.Do(func() {
+		close(w.quit)
+	})
+}
+
+func (w *limitsWatcher) check() {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("limits file %s: %v", w.path, err)
+		}
+		return
+	}
+	if fi.ModTime().Equal(w.modTime) {
+		return
+	}
+	w.modTime = fi.ModTime()
+
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		log.Warnf("limits file %s: %v", w.path, err)
+		return
+	}
+	var conf LimitsConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		log.Errorf("limits file %s: invalid: %v", w.path, err)
+		return
+	}
+	if err := w.server.ApplyLimits(&conf); err != nil {
+		log.Errorf("limits file %s: not applied: %v", w.path, err)
+		return
+	}
+	log.Infof("limits file %s applied", w.path)
+}
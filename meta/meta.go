@@ -0,0 +1,199 @@
+// Package meta reads and writes the grpc metadata of contexts.
+//
+// The setters never modify the metadata held by the given context, which may
+// be shared by concurrent goroutines, they return a context with a modified
+// copy. Keys are lowercased. The values of binary keys, suffixed by "-bin",
+// are raw bytes: grpc encodes them in base64 on the wire and decodes them on
+// reception.
+package meta
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// Well-known headers.
+const (
+	// RequestID identifies a request across services.
+	RequestID = "x-request-id"
+	// DebugLog forces the logging of a call when true.
+	DebugLog = "x-debug-log"
+	// RetryAttempt is the number of the attempt, set on retries only.
+	RetryAttempt = "x-retry-attempty"
+	// Priority is the priority of a call: critical, normal or sheddable.
+	Priority = "x-priority"
+	// IdempotencyKey identifies a logical call across its retries and hedged copies.
+	IdempotencyKey = "x-idempotency-key"
+	// RetryPushback is the trailer telling the client how many milliseconds
+	// to wait before retrying, or not to retry if negative.
+	RetryPushback = "grpc-retry-pushback-ms"
+)
+
+const binSuffix = "-bin"
+
+// IsBinary reports whether the values of key are binary.
+func IsBinary(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), binSuffix)
+}
+
+// ------------- incoming
+
+// Get returns the first value of key in the incoming metadata.
+func Get(ctx context.Context, key string) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return first(md, key)
+}
+
+// Values returns all the values of key in the incoming metadata.
+func Values(ctx context.Context, key string) []string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md[strings.ToLower(key)]
+}
+
+// GetBinary returns the first value of the binary key in the incoming metadata.
+func GetBinary(ctx context.Context, key string) ([]byte, bool) {
+	v, ok := Get(ctx, key)
+	if !ok || !IsBinary(key) {
+		return nil, false
+	}
+	return []byte(v), true
+}
+
+func GetInt(ctx context.Context, key string) (int64, bool) {
+	v, ok := Get(ctx, key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	return i, err == nil
+}
+
+// GetDuration parses the first value of key as by time.ParseDuration.
+func GetDuration(ctx context.Context, key string) (time.Duration, bool) {
+	v, ok := Get(ctx, key)
+	if !ok {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil
+}
+
+// GetBool parses the first value of key as by strconv.ParseBool.
+func GetBool(ctx context.Context, key string) (bool, bool) {
+	v, ok := Get(ctx, key)
+	if !ok {
+		return false, false
+	}
+	b, err := strconv.ParseBool(v)
+	return b, err == nil
+}
+
+// SetIncoming replaces the values of key in the incoming metadata.
+func SetIncoming(ctx context.Context, key string, values ...string) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return metadata.NewIncomingContext(ctx, set(md, key, values))
+}
+
+// AppendIncoming adds values to the values of key in the incoming metadata.
+func AppendIncoming(ctx context.Context, key string, values ...string) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return metadata.NewIncomingContext(ctx, appendValues(md, key, values))
+}
+
+// DeleteIncoming removes key from the incoming metadata.
+func DeleteIncoming(ctx context.Context, key string) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return metadata.NewIncomingContext(ctx, del(md, key))
+}
+
+// ------------- outgoing
+
+// GetOutgoing returns the first value of key in the outgoing metadata.
+func GetOutgoing(ctx context.Context, key string) (string, bool) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return first(md, key)
+}
+
+// OutgoingValues returns all the values of key in the outgoing metadata.
+func OutgoingValues(ctx context.Context, key string) []string {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return md[strings.ToLower(key)]
+}
+
+// SetOutgoing replaces the values of key in the outgoing metadata.
+func SetOutgoing(ctx context.Context, key string, values ...string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, set(md, key, values))
+}
+
+// SetOutgoingBinary replaces the values of key in the outgoing metadata by
+// value, key is suffixed by "-bin" if it is not already.
+func SetOutgoingBinary(ctx context.Context, key string, value []byte) context.Context {
+	if !IsBinary(key) {
+		key += binSuffix
+	}
+	return SetOutgoing(ctx, key, string(value))
+}
+
+func SetOutgoingInt(ctx context.Context, key string, value int64) context.Context {
+	return SetOutgoing(ctx, key, strconv.FormatInt(value, 10))
+}
+
+func SetOutgoingDuration(ctx context.Context, key string, value time.Duration) context.Context {
+	return SetOutgoing(ctx, key, value.String())
+}
+
+func SetOutgoingBool(ctx context.Context, key string, value bool) context.Context {
+	return SetOutgoing(ctx, key, strconv.FormatBool(value))
+}
+
+// AppendOutgoing adds values to the values of key in the outgoing metadata.
+func AppendOutgoing(ctx context.Context, key string, values ...string) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, appendValues(md, key, values))
+}
+
+// DeleteOutgoing removes key from the outgoing metadata.
+func DeleteOutgoing(ctx context.Context, key string) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, del(md, key))
+}
+
+// -------------
+
+func first(md metadata.MD, key string) (string, bool) {
+	values := md[strings.ToLower(key)]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func set(md metadata.MD, key string, values []string) metadata.MD {
+	md = md.Copy()
+	md[strings.ToLower(key)] = append([]string(nil), values...)
+	return md
+}
+
+func appendValues(md metadata.MD, key string, values []string) metadata.MD {
+	md = md.Copy()
+	key = strings.ToLower(key)
+	md[key] = append(md[key], values...)
+	return md
+}
+
+func del(md metadata.MD, key string) metadata.MD {
+	md = md.Copy()
+	delete(md, strings.ToLower(key))
+	return md
+}
@@ -2,12 +2,38 @@ package xmiddleware
 
 import (
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/interceptor"
 )
 
 type options struct {
-	mc *monitorConf
-	rc *rateLimitConf
-	tc *throttlerConf
+	logger     *interceptor.RequestLogger
+	mc         *monitorConf
+	errorCodes []codes.Code
+	reporter   interceptor.ErrorReporter
+	registerer prometheus.Registerer
+	name       string
+	rc         *rateLimitConf
+	krc        *keyedRateLimitConf
+	maxKeys    int
+	qc         *quotaConf
+	tc         *throttlerConf
+	ac         *adaptiveConf
+	pc         *priorityConf
+	cc         *codelConf
+
+	metricsPort   int
+	drainTimeout  time.Duration
+	shutdownDelay time.Duration
+	minProcessing time.Duration
+	hc            *healthConf
+	lc            *limitsConf
+	dc            *dedupConf
 }
 
 type monitorConf struct {
@@ -20,6 +46,21 @@ type rateLimitConf struct {
 	fillInterval time.Duration
 	capacity     int64
 	quantum      int64
+	reject       bool
+	maxWait      time.Duration
+}
+
+type quotaConf struct {
+	backend      interceptor.QuotaBackend
+	key          string
+	syncInterval time.Duration
+}
+
+type keyedRateLimitConf struct {
+	keyFunc     interceptor.KeyFunc
+	defaultConf *interceptor.BucketConf
+	confs       map[string]interceptor.BucketConf
+	idleTimeout time.Duration
 }
 
 type throttlerConf struct {
@@ -28,8 +69,61 @@ type throttlerConf struct {
 	backlogTimeout time.Duration
 }
 
+type priorityConf struct {
+	classify interceptor.PriorityFunc
+	reserved map[interceptor.Priority]int
+}
+
+type codelConf struct {
+	target   time.Duration
+	interval time.Duration
+}
+
+type dedupConf struct {
+	store interceptor.DedupStore
+	ttl   time.Duration
+}
+
+type limitsConf struct {
+	path     string
+	interval time.Duration
+}
+
+type healthConf struct {
+	interval       time.Duration
+	throttleWindow time.Duration
+	panicThreshold int
+	panicWindow    time.Duration
+	checks         []healthCheck
+}
+
+type healthCheck struct {
+	service string
+	check   func(ctx context.Context) error
+}
+
+type adaptiveConf struct {
+	minLimit int
+	maxLimit int
+	window   time.Duration
+}
+
 type XServerOption func(*options)
 
+func (o *options) health() *healthConf {
+	if o.hc == nil {
+		o.hc = &healthConf{interval: 5 * time.Second}
+	}
+	return o.hc
+}
+
+// Logging configures the request logging, which is always on.
+func Logging(loggingOpts ...interceptor.LoggingOption) XServerOption {
+	return func(o *options) {
+		o.logger = interceptor.NewRequestLogger(loggingOpts...)
+	}
+}
+
 func Monitor(application string, port int, sentryDSN string) XServerOption {
 	return func(o *options) {
 		o.mc = &monitorConf{
@@ -40,6 +134,96 @@ func Monitor(application string, port int, sentryDSN string) XServerOption {
 	}
 }
 
+// MonitorErrorCodes sets the codes the Monitor counts as errors, instead of interceptor.DefaultErrorCodes.
+func MonitorErrorCodes(errorCodes ...codes.Code) XServerOption {
+	return func(o *options) {
+		o.errorCodes = errorCodes
+	}
+}
+
+// MonitorReporter sets the reporter of the Monitor instead of the sentry one,
+// e.g. interceptor.NewFilteredReporter to drop expected errors.
+func MonitorReporter(reporter interceptor.ErrorReporter) XServerOption {
+	return func(o *options) {
+		o.reporter = reporter
+	}
+}
+
+// MonitorRegisterer sets the registerer of the Monitor metrics instead of the default one.
+func MonitorRegisterer(registerer prometheus.Registerer) XServerOption {
+	return func(o *options) {
+		o.registerer = registerer
+	}
+}
+
+// ServerName labels the metrics of the throttler and the rate limiter with
+// server=name, it must be distinct among the servers sharing a registerer for
+// their metrics to be exported, only the first server of a name is.
+func ServerName(name string) XServerOption {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// MetricsServer makes XServer serve the metrics on metricsPort.
+func MetricsServer(metricsPort int) XServerOption {
+	return func(o *options) {
+		o.metricsPort = metricsPort
+	}
+}
+
+// DrainTimeout bounds the graceful stop of XServer, after which the remaining
+// calls are cancelled. It is 10s by default.
+func DrainTimeout(timeout time.Duration) XServerOption {
+	return func(o *options) {
+		o.drainTimeout = timeout
+	}
+}
+
+// ShutdownDelay makes XServer keep serving for delay after reporting
+// NOT_SERVING on stop, so that the load balancers stop sending new calls
+// before it drains. The delay counts within DrainTimeout.
+func ShutdownDelay(delay time.Duration) XServerOption {
+	return func(o *options) {
+		o.shutdownDelay = delay
+	}
+}
+
+// Health registers the health service, whose status is updated every interval.
+// Any of the Health* options enables it too, with a 5s interval.
+func Health(interval time.Duration) XServerOption {
+	return func(o *options) {
+		o.health().interval = interval
+	}
+}
+
+// HealthThrottleWindow marks the server NOT_SERVING while the Throttler
+// backlog has been saturated for window.
+func HealthThrottleWindow(window time.Duration) XServerOption {
+	return func(o *options) {
+		o.health().throttleWindow = window
+	}
+}
+
+// HealthPanicThreshold marks the server NOT_SERVING while Monitor recovered
+// panics or more within the last window.
+func HealthPanicThreshold(panics int, window time.Duration) XServerOption {
+	return func(o *options) {
+		hc := o.health()
+		hc.panicThreshold = panics
+		hc.panicWindow = window
+	}
+}
+
+// HealthCheck marks service NOT_SERVING while check fails, the empty service
+// stands for the whole server. check is given the interval as timeout.
+func HealthCheck(service string, check func(ctx context.Context) error) XServerOption {
+	return func(o *options) {
+		hc := o.health()
+		hc.checks = append(hc.checks, healthCheck{service: service, check: check})
+	}
+}
+
 // quantum tokens are added every fillInterval, up to the given maximum capacity
 func RateLimit(fillInterval time.Duration, capacity int64, quantum int64) XServerOption {
 	return func(o *options) {
@@ -51,6 +235,54 @@ func RateLimit(fillInterval time.Duration, capacity int64, quantum int64) XServe
 	}
 }
 
+// RejectingRateLimit is like RateLimit, but rejects the calls which would wait
+// more than maxWait or their remaining deadline, with ResourceExhausted.
+func RejectingRateLimit(fillInterval time.Duration, capacity int64, quantum int64, maxWait time.Duration) XServerOption {
+	return func(o *options) {
+		o.rc = &rateLimitConf{
+			fillInterval: fillInterval,
+			capacity:     capacity,
+			quantum:      quantum,
+			reject:       true,
+			maxWait:      maxWait,
+		}
+	}
+}
+
+// RateLimitBackend makes the rate of RateLimit cluster-wide, counted through
+// backend under key, see RateLimiter.SetBackend.
+func RateLimitBackend(backend interceptor.QuotaBackend, key string, syncInterval time.Duration) XServerOption {
+	return func(o *options) {
+		o.qc = &quotaConf{
+			backend:      backend,
+			key:          key,
+			syncInterval: syncInterval,
+		}
+	}
+}
+
+// KeyedRateLimit limits every key given by keyFunc with its own bucket, from
+// confs or else defaultConf, evicting the buckets idle for idleTimeout, never if
+// idleTimeout <= 0, and the least recently used beyond KeyedRateLimitMaxKeys.
+func KeyedRateLimit(keyFunc interceptor.KeyFunc, defaultConf *interceptor.BucketConf, confs map[string]interceptor.BucketConf, idleTimeout time.Duration) XServerOption {
+	return func(o *options) {
+		o.krc = &keyedRateLimitConf{
+			keyFunc:     keyFunc,
+			defaultConf: defaultConf,
+			confs:       confs,
+			idleTimeout: idleTimeout,
+		}
+	}
+}
+
+// KeyedRateLimitMaxKeys bounds the buckets of KeyedRateLimit to maxKeys, see
+// KeyedRateLimiter.SetMaxKeys.
+func KeyedRateLimitMaxKeys(maxKeys int) XServerOption {
+	return func(o *options) {
+		o.maxKeys = maxKeys
+	}
+}
+
 func Throttler(limit int, backlogLimit int, backlogTimeout time.Duration) XServerOption {
 	return func(o *options) {
 		o.tc = &throttlerConf{
@@ -60,3 +292,188 @@ func Throttler(limit int, backlogLimit int, backlogTimeout time.Duration) XServe
 		}
 	}
 }
+
+// AdaptiveThrottler makes the limit of Throttler follow the latency of the calls
+// within [minLimit, maxLimit], updated every window, see Throttler.SetAdaptive.
+func AdaptiveThrottler(minLimit int, maxLimit int, window time.Duration) XServerOption {
+	return func(o *options) {
+		o.ac = &adaptiveConf{
+			minLimit: minLimit,
+			maxLimit: maxLimit,
+			window:   window,
+		}
+	}
+}
+
+// Deduplicate serves the unary calls repeated with the same idempotency key
+// within ttl from the first response, see Deduplicator.
+func Deduplicate(store interceptor.DedupStore, ttl time.Duration) XServerOption {
+	return func(o *options) {
+		o.dc = &dedupConf{
+			store: store,
+			ttl:   ttl,
+		}
+	}
+}
+
+// LimitsConfigFile watches the JSON file path every interval and applies the
+// limits it holds whenever it changes, see LimitsConfig.
+func LimitsConfigFile(path string, interval time.Duration) XServerOption {
+	return func(o *options) {
+		o.lc = &limitsConf{
+			path:     path,
+			interval: interval,
+		}
+	}
+}
+
+// MinProcessingTime makes Throttler and RateLimiter reject at once the calls
+// whose deadline would leave less than d to be served after their wait, see
+// Throttler.SetMinProcessing.
+func MinProcessingTime(d time.Duration) XServerOption {
+	return func(o *options) {
+		o.minProcessing = d
+	}
+}
+
+// ThrottlerPriorities makes Throttler run the important calls first and shed the
+// less important ones first, see Throttler.SetPriorities.
+func ThrottlerPriorities(classify interceptor.PriorityFunc, reserved map[interceptor.Priority]int) XServerOption {
+	return func(o *options) {
+		o.pc = &priorityConf{
+			classify: classify,
+			reserved: reserved,
+		}
+	}
+}
+
+// ThrottlerCoDel makes the backlog of Throttler LIFO when standing and sheds
+// the stale calls, see Throttler.SetCoDel.
+func ThrottlerCoDel(target time.Duration, interval time.Duration) XServerOption {
+	return func(o *options) {
+		o.cc = &codelConf{
+			target:   target,
+			interval: interval,
+		}
+	}
+}
+
+// -------------
+
+type clientOptions struct {
+	logger      *interceptor.RequestLogger
+	application string
+	registerer  prometheus.Registerer
+	rc          *rateLimitConf
+	retryOpts   []interceptor.CallOption
+	breaker     *breakerConf
+	hedge       *interceptor.HedgeConf
+	idempotency *interceptor.IdempotencyRegistry
+	budget      *budgetConf
+	timeout     time.Duration
+	dialOpts    []grpc.DialOption
+}
+
+type XClientOption func(*clientOptions)
+
+type budgetConf struct {
+	ratio    float64
+	capacity int
+}
+
+type breakerConf struct {
+	conf  interceptor.BreakerConf
+	hooks []interceptor.BreakerHook
+}
+
+// ClientLogging configures the request logging, which is always on.
+func ClientLogging(loggingOpts ...interceptor.LoggingOption) XClientOption {
+	return func(o *clientOptions) {
+		o.logger = interceptor.NewRequestLogger(loggingOpts...)
+	}
+}
+
+// ClientMonitor enables client metrics namespaced by application.
+func ClientMonitor(application string) XClientOption {
+	return func(o *clientOptions) {
+		o.application = application
+	}
+}
+
+// ClientMonitorRegisterer sets the registerer of the client metrics instead of the default one.
+func ClientMonitorRegisterer(registerer prometheus.Registerer) XClientOption {
+	return func(o *clientOptions) {
+		o.registerer = registerer
+	}
+}
+
+// quantum tokens are added every fillInterval, up to the given maximum capacity
+func ClientRateLimit(fillInterval time.Duration, capacity int64, quantum int64) XClientOption {
+	return func(o *clientOptions) {
+		o.rc = &rateLimitConf{
+			fillInterval: fillInterval,
+			capacity:     capacity,
+			quantum:      quantum,
+		}
+	}
+}
+
+// ClientRetry sets the default retry options, they can be overridden per call.
+func ClientRetry(retryOpts ...interceptor.CallOption) XClientOption {
+	return func(o *clientOptions) {
+		o.retryOpts = append(o.retryOpts, retryOpts...)
+	}
+}
+
+// ClientRetryBudget bounds the retries to ratio of the calls to the target,
+// with a reserve of capacity retries, see RetryBudget.
+func ClientRetryBudget(ratio float64, capacity int) XClientOption {
+	return func(o *clientOptions) {
+		o.budget = &budgetConf{
+			ratio:    ratio,
+			capacity: capacity,
+		}
+	}
+}
+
+// ClientIdempotency tells the retries and the hedging which methods are safe to
+// call more than once, see WithIdempotency.
+func ClientIdempotency(registry *interceptor.IdempotencyRegistry) XClientOption {
+	return func(o *clientOptions) {
+		o.idempotency = registry
+	}
+}
+
+// ClientHedging sends copies of the slow calls to the idempotent methods of
+// the target, see Hedger. The methods are the ones of conf.Idempotency, else
+// of ClientIdempotency, one of them is required.
+func ClientHedging(conf interceptor.HedgeConf) XClientOption {
+	return func(o *clientOptions) {
+		o.hedge = &conf
+	}
+}
+
+// ClientCircuitBreaker fails fast the attempts to a method of the target while
+// it keeps failing, see CircuitBreaker.
+func ClientCircuitBreaker(conf interceptor.BreakerConf, hooks ...interceptor.BreakerHook) XClientOption {
+	return func(o *clientOptions) {
+		o.breaker = &breakerConf{
+			conf:  conf,
+			hooks: hooks,
+		}
+	}
+}
+
+// ClientTimeout sets the deadline for calls whose context has none.
+func ClientTimeout(timeout time.Duration) XClientOption {
+	return func(o *clientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// ClientDialOptions appends raw dial options, e.g. grpc.WithInsecure().
+func ClientDialOptions(dialOpts ...grpc.DialOption) XClientOption {
+	return func(o *clientOptions) {
+		o.dialOpts = append(o.dialOpts, dialOpts...)
+	}
+}
@@ -5,45 +5,132 @@ import (
 	"net/http"
 
 	"github.com/eddyzhou/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/interceptor"
 )
 
+// NewServer builds the grpc server only: the health status is not updated and
+// the limits file is not watched, which are done by XServer while serving.
 func NewServer(sos ...XServerOption) *grpc.Server {
 	opt := &options{}
 	for _, o := range sos {
 		o(opt)
 	}
+	return newServer(opt).Server
+}
+
+// newServer builds the grpc server of XServer, with the health service if
+// configured. Its watchers are started by XServer.Serve.
+func newServer(opt *options) *XServer {
+	var (
+		m  *interceptor.Monitor
+		t  *interceptor.Throttler
+		rl *interceptor.RateLimiter
+	)
 
-	chain := interceptor.UnaryServerChain(interceptor.Logging)
+	logger := opt.logger
+	if logger == nil {
+		logger = interceptor.NewRequestLogger()
+	}
+	chain := interceptor.UnaryServerChain(logger.Logging)
+	streamChain := interceptor.StreamServerChain(logger.StreamLogging)
+	if dc := opt.dc; dc != nil {
+		d := interceptor.NewDeduplicator(dc.store, dc.ttl)
+		chain = interceptor.UnaryServerChain(chain, d.Dedup)
+	}
+
+	application := ""
+	if opt.mc != nil {
+		application = opt.mc.application
+	}
 
 	if opt.tc != nil {
 		tc := opt.tc
-		t := interceptor.NewThrottler(tc.limit, tc.backlogLimit, tc.backlogTimeout)
+		t = interceptor.NewThrottler(tc.limit, tc.backlogLimit, tc.backlogTimeout)
+		if ac := opt.ac; ac != nil {
+			t.SetAdaptive(ac.minLimit, ac.maxLimit, ac.window)
+		}
+		if pc := opt.pc; pc != nil {
+			t.SetPriorities(pc.classify, pc.reserved)
+		}
+		if cc := opt.cc; cc != nil {
+			t.SetCoDel(cc.target, cc.interval)
+		}
+		t.SetMinProcessing(opt.minProcessing)
+		t.RegisterMetrics(application, opt.name, opt.registerer)
 		chain = interceptor.UnaryServerChain(t.Throttle, chain)
+		streamChain = interceptor.StreamServerChain(t.StreamThrottle, streamChain)
 	}
 	if opt.rc != nil {
 		rc := opt.rc
-		rl := interceptor.NewRateLimiter(rc.fillInterval, rc.capacity, rc.quantum)
+		rl = interceptor.NewRateLimiter(rc.fillInterval, rc.capacity, rc.quantum)
+		if rc.reject {
+			rl.SetMaxWait(rc.maxWait)
+		}
+		if qc := opt.qc; qc != nil {
+			rl.SetBackend(qc.backend, qc.key, qc.syncInterval)
+		}
+		rl.SetMinProcessing(opt.minProcessing)
+		rl.RegisterMetrics(application, opt.name, opt.registerer)
 		chain = interceptor.UnaryServerChain(rl.RateLimit, chain)
+		streamChain = interceptor.StreamServerChain(rl.StreamRateLimit, streamChain)
+	}
+	if opt.krc != nil {
+		krc := opt.krc
+		krl := interceptor.NewKeyedRateLimiter(krc.keyFunc, krc.defaultConf, krc.confs, krc.idleTimeout)
+		if opt.maxKeys > 0 {
+			krl.SetMaxKeys(opt.maxKeys)
+		}
+		chain = interceptor.UnaryServerChain(krl.RateLimit, chain)
+		streamChain = interceptor.StreamServerChain(krl.StreamRateLimit, streamChain)
 	}
 	if opt.mc != nil {
 		mc := opt.mc
-		m, err := interceptor.NewMonitor(mc.application, mc.port, mc.sentryDSN)
+		var err error
+		m, err = interceptor.NewMonitor(mc.application, mc.port, mc.sentryDSN, opt.registerer)
 		if err != nil {
 			panic(err)
 		}
+		if len(opt.errorCodes) > 0 {
+			m.SetErrorCodes(opt.errorCodes...)
+		}
+		if opt.reporter != nil {
+			m.SetReporter(opt.reporter)
+		}
 		chain = interceptor.UnaryServerChain(m.Recovery, m.Monitoring, chain)
+		streamChain = interceptor.StreamServerChain(m.StreamRecovery, m.StreamMonitoring, streamChain)
 	}
 
-	return grpc.NewServer(grpc.UnaryInterceptor(chain))
+	xs := &XServer{
+		Server:      grpc.NewServer(grpc.UnaryInterceptor(chain), grpc.StreamInterceptor(streamChain)),
+		Throttler:   t,
+		RateLimiter: rl,
+		monitor:     m,
+	}
+	if opt.hc != nil {
+		xs.Health = NewHealthServer()
+		healthpb.RegisterHealthServer(xs.Server, xs.Health)
+		xs.watcher = newHealthWatcher(xs.Health, xs.Server, t, m, opt.hc)
+	}
+	if opt.lc != nil {
+		xs.limits = newLimitsWatcher(xs, opt.lc.path, opt.lc.interval)
+	}
+	return xs
 }
 
 func StartMetricsServer(metricsPort int) {
+	StartMetricsServerFor(metricsPort, prometheus.DefaultGatherer)
+}
+
+// StartMetricsServerFor serves the metrics of gatherer on its own mux.
+func StartMetricsServerFor(metricsPort int, gatherer prometheus.Gatherer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", metricsPort), nil))
+		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", metricsPort), mux))
 	}()
 }
@@ -1,49 +1,26 @@
 package utils
 
 import (
-	"encoding/base64"
-	"strings"
-
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/metadata"
-)
 
-const (
-	binSuffix = "-bin"
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/meta"
 )
 
+// Get returns the first value of key in the incoming metadata.
+//
+// Deprecated: use meta.Get.
 func Get(ctx context.Context, key string) (string, bool) {
-	md, ok := metadata.FromContext(ctx)
-	if !ok {
-		return "", false
-	}
-	key = strings.ToLower(key)
-	valSlice, ok := md[key]
-	if !ok {
-		return "", false
-	}
-	if len(valSlice) != 1 {
-		return "", false
-	}
-	return valSlice[0], true
+	return meta.Get(ctx, key)
 }
 
+// Set sets key in a copy of the incoming metadata if ctx has some, else of the
+// outgoing metadata.
+//
+// Deprecated: use meta.SetIncoming or meta.SetOutgoing.
 func Set(ctx context.Context, key string, value string) context.Context {
-	md, ok := metadata.FromContext(ctx)
-	if !ok {
-		md = metadata.Pairs(key, value)
-		return metadata.NewContext(ctx, md)
-	}
-	k, v := encode(key, value)
-	md[k] = []string{v}
-	return ctx // we use the same context because we modified the metadata in place.
-}
-
-func encode(k, v string) (string, string) {
-	k = strings.ToLower(k)
-	if strings.HasSuffix(k, binSuffix) {
-		val := base64.StdEncoding.EncodeToString([]byte(v))
-		v = string(val)
+	if _, ok := metadata.FromIncomingContext(ctx); ok {
+		return meta.SetIncoming(ctx, key, value)
 	}
-	return k, v
+	return meta.SetOutgoing(ctx, key, value)
 }
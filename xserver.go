@@ -0,0 +1,173 @@
+package xmiddleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eddyzhou/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"xlbj-gitlab.xunlei.cn/shoulei-service/xmiddleware/interceptor"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Second
+)
+
+// XServer owns the grpc server, its listener, the metrics server and the
+// health service, and stops them gracefully on SIGTERM/SIGINT. Throttler and
+// RateLimiter are nil unless configured, their limits can be changed while
+// serving, see ApplyLimits.
+type XServer struct {
+	*grpc.Server
+	Health      *HealthServer
+	Throttler   *interceptor.Throttler
+	RateLimiter *interceptor.RateLimiter
+
+	monitor      *interceptor.Monitor
+	watcher      *healthWatcher
+	limits       *limitsWatcher
+	metrics      *http.Server
+	drainTimeout time.Duration
+	delay        time.Duration
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewXServer builds the server like NewServer, services are registered on the embedded grpc.Server.
+func NewXServer(sos ...XServerOption) *XServer {
+	opt := &options{drainTimeout: defaultDrainTimeout}
+	for _, o := range sos {
+		o(opt)
+	}
+
+	s := newServer(opt)
+	s.drainTimeout = opt.drainTimeout
+	s.delay = opt.shutdownDelay
+	if s.delay > s.drainTimeout {
+		s.delay = s.drainTimeout
+	}
+	s.quit = make(chan struct{})
+	if s.Health == nil {
+		s.Health = NewHealthServer()
+		healthpb.RegisterHealthServer(s.Server, s.Health)
+	}
+
+	if opt.metricsPort > 0 {
+		gatherer := prometheus.DefaultGatherer
+		if g, ok := opt.registerer.(prometheus.Gatherer); ok {
+			gatherer = g
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+		s.metrics = &http.Server{Addr: fmt.Sprintf(":%v", opt.metricsPort), Handler: mux}
+	}
+	return s
+}
+
+func (s *XServer) ListenAndServe(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// Serve blocks until the server fails, is signaled or Shutdown is called, then
+// stops it gracefully. It returns nil if the server was stopped on purpose.
+func (s *XServer) Serve(lis net.Listener) error {
+	if s.watcher != nil {
+		go s.watcher.run()
+	}
+	if s.limits != nil {
+		go s.limits.run()
+	}
+	if s.metrics != nil {
+		go func() {
+			if err := s.metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Server.Serve(lis)
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+
+	var err error
+	select {
+	case err = <-errCh:
+		log.Errorf("grpc server failed: %v", err)
+	case sig := <-sigCh:
+		log.Infof("grpc server received %v, stopping", sig)
+	case <-s.quit:
+		log.Info("grpc server shutdown, stopping")
+	}
+	s.stop()
+	return err
+}
+
+// Shutdown makes Serve stop the server gracefully.
+func (s *XServer) Shutdown() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+func (s *XServer) stop() {
+	if s.watcher != nil {
+		s.watcher.stop()
+	}
+	if s.limits != nil {
+		s.limits.stop()
+	}
+	s.Health.Shutdown()
+	if s.delay > 0 {
+		log.Infof("grpc server not serving, draining in %v", s.delay)
+		time.Sleep(s.delay)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(s.drainTimeout - s.delay)
+	select {
+	case <-stopped:
+		timer.Stop()
+	case <-timer.C:
+		log.Warnf("grpc server not drained in %v, stopping", s.drainTimeout)
+		s.Server.Stop()
+	}
+
+	if s.RateLimiter != nil {
+		s.RateLimiter.Stop()
+	}
+	if s.metrics != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := s.metrics.Shutdown(ctx); err != nil {
+			log.Warnf("metrics server shutdown: %v", err)
+		}
+		cancel()
+	}
+	if s.monitor != nil {
+		s.monitor.Flush()
+	}
+}